@@ -0,0 +1,13 @@
+// Package eval evaluates parsed makefiles: variables are assigned and expanded,
+// conditionals are decided, included makefiles are read and rules are added
+// to a graph of targets, together with the built-in variables and rules.
+//
+// A makefile can be loaded and queried like this:
+//
+//	db, err := eval.Load(eval.Options{Environment: os.Environ()}, "Makefile")
+//	if err != nil {
+//		return err
+//	}
+//	cc, err := db.Value("CC")
+//	t := db.Graph.Lookup("main.o")
+package eval
@@ -0,0 +1,76 @@
+package eval
+
+import (
+	"strings"
+	"testing"
+)
+
+// environmentMakefile sets variables that are also in the environment of TestEnvironment
+const environmentMakefile = `FOO = file
+BAR = bar
+export BAR
+unexport GONE
+PLAIN = plain
+x: export TARGET = target
+`
+
+// TestEnvironment checks which variables come from the environment, with and without -e,
+// and which variables are exported to the environment of recipes
+func TestEnvironment(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		first       bool
+		extra       string
+		target      string
+		foo         string
+		exported    []string
+		notExported []string
+	}{
+		{"makefile first", false, "", "", "file",
+			[]string{"FOO=file", "BAR=bar", "SHELL=/bin/bash"}, []string{"GONE", "PLAIN", "TARGET"}},
+		{"environment first", true, "", "", "env",
+			[]string{"FOO=env", "BAR=bar"}, []string{"GONE", "PLAIN"}},
+		{"export all", false, ".EXPORT_ALL_VARIABLES:\n", "", "file",
+			[]string{"FOO=file", "PLAIN=plain"}, []string{"GONE"}},
+		{"export everything", false, "export\n", "", "file",
+			[]string{"FOO=file", "PLAIN=plain"}, []string{"GONE"}},
+		{"target-specific", false, "", "x", "file",
+			[]string{"FOO=file", "TARGET=target"}, []string{"GONE", "PLAIN"}},
+	} {
+		db, _ := loadString(t, Options{
+			Environment:      []string{"FOO=env", "GONE=gone", "SHELL=/bin/bash"},
+			EnvironmentFirst: test.first,
+		}, environmentMakefile+test.extra)
+		if foo, err := db.Value("FOO"); err != nil || foo != test.foo {
+			t.Errorf("%s: $(FOO) is %q, want %q", test.name, foo, test.foo)
+		}
+		// SHELL is never taken from the environment
+		if shell, err := db.Value("SHELL"); err != nil || shell != "/bin/sh" {
+			t.Errorf("%s: $(SHELL) is %q", test.name, shell)
+		}
+		var scope *Scope
+		if test.target != "" {
+			scope = db.TargetScope(test.target, nil)
+		}
+		env, err := db.Environment(scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make(map[string]string)
+		for _, s := range env {
+			if i := strings.IndexByte(s, '='); i > 0 {
+				values[s[:i]] = s
+			}
+		}
+		for _, want := range test.exported {
+			if name := want[:strings.IndexByte(want, '=')]; values[name] != want {
+				t.Errorf("%s: the environment has %q, want %q", test.name, values[name], want)
+			}
+		}
+		for _, name := range test.notExported {
+			if s, found := values[name]; found {
+				t.Errorf("%s: the environment has %q", test.name, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,1236 @@
+package eval
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xyproto/ake/graph"
+	"github.com/xyproto/ake/parse"
+)
+
+// Version is the version of GNU Make that is mimicked, as found in $(MAKE_VERSION)
+const Version = "4.3"
+
+// Options is how makefiles should be evaluated
+type Options struct {
+	FS                 fs.FS     // read makefiles and expand $(wildcard ...) from this file system, instead of the current directory
+	Environment        []string  // the environment, as "NAME=value" strings, like from os.Environ()
+	EnvironmentFirst   bool      // environment variables override assignments in makefiles, as with -e
+	Variables          []string  // variables given on the command line, as "NAME=value" strings
+	MakeFlags          string    // the value of $(MAKEFLAGS), which is exported for sub-makes
+	Command            string    // the command that runs make, for $(MAKE), "make" if not set
+	Goals              []string  // the goals given on the command line, available as $(MAKECMDGOALS)
+	Eval               []string  // makefile text that is evaluated before the makefiles are read, as with --eval
+	Verbose            bool      // print the name of each makefile as it is read, as with --debug=v
+	WarnUndefined      bool      // warn about references to variables that are not defined, as with --warn-undefined-variables
+	AllowMissing       bool      // included makefiles that are not found are not an error, so that they can be made first
+	IncludeDirs        []string  // directories to search for included makefiles, as with -I
+	NoBuiltinRules     bool      // do not define the built-in implicit rules, as with -r
+	NoBuiltinVariables bool      // do not define the built-in variables, as with -R
+	Stdout             io.Writer // where $(info ...) writes, os.Stdout if nil
+	Stderr             io.Writer // where warnings and $(warning ...) writes, os.Stderr if nil
+}
+
+// Database is the result of evaluating one or more makefiles:
+// the variables, the targets with their prerequisites and recipes, and the pattern rules.
+type Database struct {
+	Globals   *Scope            // the global variables
+	Graph     *graph.Graph      // all targets and pattern rules
+	Makefiles []*parse.File     // the makefiles that have been read, including the included ones
+	Suffixes  []string          // the known suffixes, as given by .SUFFIXES
+	Missing   []MissingMakefile // included makefiles that were not found
+	options   Options           // the options the database was created with
+	mut       sync.Mutex        // for the maps below, since $(eval ...) may be used from recipes
+	targets   map[string]*Scope // target-specific variables, by target name
+	patterns  []*patternScope   // pattern-specific variables, in the order they were defined
+	exports   map[string]bool   // variables that are exported (true) or unexported (false)
+	environ   map[string]string // the environment that was given in the options
+	level     int               // $(MAKELEVEL), which is 0 for the top-level make
+	exportAll bool              // "export" without arguments was given
+	names     []string          // the names of the makefiles, including the missing ones, in the order they were included
+}
+
+// patternScope holds the pattern-specific variables for targets matching a pattern, like "%.o"
+type patternScope struct {
+	pattern string
+	scope   *Scope
+}
+
+// MissingMakefile is an included makefile that could not be found
+type MissingMakefile struct {
+	Name     string
+	Pos      graph.Position // where it was included
+	Optional bool           // included with "-include", so it does not have to exist
+}
+
+// evaluator goes through the nodes of a parsed makefile, in order, and stores
+// variables, rules and recipes in the database
+type evaluator struct {
+	db      *Database
+	file    *parse.File
+	line    int    // if set, all positions use this line, as for the text given to $(eval ...)
+	origin  Origin // the origin of variables that are defined
+	builtin bool   // the rules are built-in rules
+	rule    *ruleContext
+}
+
+// ruleContext is the rule that recipe lines are added to, while evaluating
+type ruleContext struct {
+	targets     []*graph.Target
+	rules       []*graph.Rule                     // for "::" rules, the rule of each target
+	prereqs     map[*graph.Target][]*graph.Target // the normal prerequisites given by this rule, for each target
+	deferred    map[*graph.Target]*graph.Deferred // the prerequisites that are expanded a second time, for each target
+	pattern     *graph.PatternRule                // set if this is a pattern rule
+	recipe      *graph.Recipe                     // the recipe, once the first recipe line is found
+	doubleColon bool
+}
+
+// New creates a database with the built-in variables and rules,
+// the environment variables and the command line variables from the given options.
+// Makefiles can then be added with ReadFile or Read, followed by Finish.
+func New(options Options) *Database {
+	db := &Database{
+		Globals: NewScope(nil),
+		Graph:   graph.New(256),
+		options: options,
+		targets: make(map[string]*Scope),
+		exports: make(map[string]bool),
+		environ: make(map[string]string),
+	}
+	set := func(name, value string, flavor Flavor, origin Origin) {
+		db.Globals.Set(&Variable{Name: name, Value: value, Flavor: flavor, Origin: origin})
+	}
+	for _, env := range options.Environment {
+		if pos := strings.Index(env, "="); pos > 0 {
+			db.environ[env[:pos]] = env[pos+1:]
+			set(env[:pos], env[pos+1:], Recursive, OriginEnvironment)
+		}
+	}
+	// SHELL is never taken from the environment, since the user's shell may not be
+	// a shell that recipes are written for. Recipes still get $SHELL from the environment.
+	if _, found := db.environ["SHELL"]; found {
+		set("SHELL", "/bin/sh", Simple, OriginFile)
+	} else {
+		set("SHELL", "/bin/sh", Simple, OriginDefault)
+	}
+	set(".SHELLFLAGS", "-c", Simple, OriginDefault)
+	set(".RECIPEPREFIX", "", Simple, OriginDefault)
+	set(".FEATURES", "target-specific order-only second-expansion else-if shortest-stem undefine nocomment", Simple, OriginDefault)
+	set("MAKE_VERSION", Version, Simple, OriginDefault)
+	set("MAKE_HOST", host(), Simple, OriginDefault)
+	command := options.Command
+	if command == "" {
+		command = "make"
+	}
+	set("MAKE_COMMAND", command, Simple, OriginDefault)
+	set("MAKE", "$(MAKE_COMMAND)", Recursive, OriginDefault)
+	set("MAKEFILES", "", Simple, OriginDefault)
+	set("MAKECMDGOALS", strings.Join(options.Goals, " "), Simple, OriginDefault)
+	set("MAKEFLAGS", strings.ReplaceAll(options.MakeFlags, "$", "$$"), Recursive, OriginFile)
+	db.exports["MAKEFLAGS"] = true
+	// $(MFLAGS) is the flags of $(MAKEFLAGS), without the variables, and with a "-" in front of the letters
+	mflags := strings.TrimSpace(options.MakeFlags)
+	if pos := strings.Index(" "+mflags+" ", " -- "); pos != -1 {
+		mflags = strings.TrimSpace(mflags[:pos])
+	}
+	mflags = strings.Join(withoutEval(mflags), " ")
+	if mflags != "" && !strings.HasPrefix(mflags, "-") {
+		mflags = "-" + mflags
+	}
+	set("MFLAGS", strings.ReplaceAll(mflags, "$", "$$"), Recursive, OriginFile)
+	// Sub-makes get a MAKELEVEL that is one higher, see environment
+	if n, err := strconv.Atoi(db.environ["MAKELEVEL"]); err == nil && n > 0 {
+		db.level = n
+	}
+	set("MAKELEVEL", strconv.Itoa(db.level), Simple, OriginEnvironment)
+	db.exports["MAKELEVEL"] = true
+	// $(MAKE_RESTARTS) is given by make itself when it restarts after remaking makefiles,
+	// and is not passed on to sub-makes
+	if _, found := db.environ["MAKE_RESTARTS"]; found {
+		db.exports["MAKE_RESTARTS"] = false
+	}
+	set(".INCLUDE_DIRS", strings.Join(db.includeDirs(), " "), Recursive, OriginDefault)
+	set("MAKEFILE_LIST", "", Simple, OriginFile)
+	set(".DEFAULT_GOAL", "", Simple, OriginFile)
+	if wd, err := os.Getwd(); err == nil {
+		set("CURDIR", wd, Simple, OriginFile)
+	}
+	if !options.NoBuiltinRules {
+		db.Suffixes = strings.Fields(defaultSuffixes)
+		set("SUFFIXES", defaultSuffixes, Simple, OriginDefault)
+	} else {
+		set("SUFFIXES", "", Simple, OriginDefault)
+	}
+	if !options.NoBuiltinVariables {
+		db.evaluateBuiltin(builtinVariables, OriginDefault)
+	}
+	db.evaluateBuiltin(automaticVariables, OriginAutomatic)
+	if !options.NoBuiltinRules {
+		db.evaluateBuiltin(builtinRules, OriginDefault)
+	}
+	for _, v := range options.Variables {
+		if a := parse.NewAssignment(v); a != nil {
+			e := &evaluator{db: db, file: &parse.File{}, origin: OriginCommandLine}
+			e.assign(db.Globals, a.Name, a.Op, a.Value, graph.Position{})
+		}
+	}
+	return db
+}
+
+// withoutEval splits the given flags at the spaces that are not escaped with a backslash,
+// and leaves out the --eval flags, which GNU Make does not give in $(MFLAGS)
+func withoutEval(flags string) []string {
+	var words []string
+	start := 0
+	for i := 0; i <= len(flags); i++ {
+		if i+1 < len(flags) && flags[i] == '\\' {
+			i++
+			continue
+		}
+		if i < len(flags) && flags[i] != ' ' {
+			continue
+		}
+		if word := flags[start:i]; word != "" && !strings.HasPrefix(word, "--eval=") {
+			words = append(words, word)
+		}
+		start = i + 1
+	}
+	return words
+}
+
+// host returns the host triplet for $(MAKE_HOST), like "x86_64-pc-linux-gnu"
+func host() string {
+	arch := runtime.GOARCH
+	switch arch {
+	case "amd64":
+		arch = "x86_64"
+	case "386":
+		arch = "i686"
+	case "arm64":
+		arch = "aarch64"
+	}
+	if runtime.GOOS == "linux" {
+		return arch + "-pc-linux-gnu"
+	}
+	return arch + "-pc-" + runtime.GOOS
+}
+
+// evaluateBuiltin evaluates the given built-in makefile text, where variables get the
+// given origin and rules are marked as built-in
+func (db *Database) evaluateBuiltin(text string, origin Origin) {
+	file := parse.ParseString("", text)
+	e := &evaluator{db: db, file: file, origin: origin, builtin: true}
+	e.evaluate(file.Nodes)
+	e.endRule()
+}
+
+// includeDirs returns the directories that are searched for included makefiles
+func (db *Database) includeDirs() []string {
+	dirs := append([]string{}, db.options.IncludeDirs...)
+	if db.options.FS == nil {
+		dirs = append(dirs, "/usr/local/include", "/usr/include")
+	}
+	return dirs
+}
+
+// Load evaluates the text given by the Eval option, then reads and evaluates the given
+// makefiles, in order. If no makefiles are given, the first of GNUmakefile, makefile and
+// Makefile that exists is read. If none of them exist, the returned database has no targets. The returned error is a parse.Diagnostics
+// if there were errors in the makefiles.
+func Load(options Options, makefiles ...string) (*Database, error) {
+	db := New(options)
+	for _, text := range options.Eval {
+		if err := db.Eval(text); err != nil {
+			return db, err
+		}
+	}
+	if len(makefiles) == 0 {
+		for _, name := range []string{"GNUmakefile", "makefile", "Makefile"} {
+			if db.exists(name) {
+				makefiles = []string{name}
+				break
+			}
+		}
+	}
+	for _, name := range makefiles {
+		if err := db.ReadFile(name); err != nil {
+			if os.IsNotExist(err) {
+				fmt.Fprintf(db.stderr(), "%s: %s: No such file or directory\n", db.Program(), name)
+				return db, parse.Diagnostics{{Severity: parse.Fatal, Message: fmt.Sprintf("No rule to make target '%s'", name)}}
+			}
+			return db, err
+		}
+	}
+	return db, db.Finish()
+}
+
+// ReadFile reads, parses and evaluates the makefile with the given name.
+// An error from reading the file is returned as it is, so that os.IsNotExist can be used.
+func (db *Database) ReadFile(name string) error {
+	if db.options.Verbose {
+		fmt.Fprintf(db.stdout(), "Reading makefile '%s'...\n", name)
+	}
+	data, err := db.readFile(name)
+	if err != nil {
+		return err
+	}
+	return db.Read(parse.ParseString(name, string(data)))
+}
+
+// Read evaluates a parsed makefile. Any fatal error is returned as a parse.Diagnostics.
+func (db *Database) Read(file *parse.File) (err error) {
+	defer recoverFatal(&err)
+	db.read(file)
+	return nil
+}
+
+// Eval evaluates the given makefile text, which is not a makefile of its own, so it is
+// not added to $(MAKEFILE_LIST) and messages are not given a position.
+// Any fatal error is returned as a parse.Diagnostics.
+func (db *Database) Eval(text string) (err error) {
+	defer recoverFatal(&err)
+	file := parse.ParseString("", text)
+	e := &evaluator{db: db, file: file, origin: OriginFile}
+	e.evaluate(file.Nodes)
+	e.endRule()
+	for _, d := range file.Diagnostics {
+		if d.Message == "missing 'endif'" {
+			panic(&fatal{d})
+		}
+	}
+	return nil
+}
+
+// read evaluates a parsed makefile, and adds it to $(MAKEFILE_LIST)
+func (db *Database) read(file *parse.File) {
+	db.Makefiles = append(db.Makefiles, file)
+	db.names = append(db.names, file.Path)
+	list := &Variable{Name: "MAKEFILE_LIST", Flavor: Simple, Origin: OriginFile}
+	if v := db.Globals.Local("MAKEFILE_LIST"); v != nil {
+		copied := *v
+		list = &copied
+	}
+	list.Value = strings.TrimLeft(list.Value+" "+file.Path, " ")
+	db.Globals.Set(list)
+	e := &evaluator{db: db, file: file, origin: OriginFile}
+	e.evaluate(file.Nodes)
+	e.endRule()
+	for _, d := range file.Diagnostics {
+		if d.Message == "missing 'endif'" {
+			panic(&fatal{d})
+		}
+	}
+}
+
+// Finish should be called after all makefiles have been read. Old-fashioned suffix rules,
+// like ".c.o:", are turned into pattern rules, and missing included makefiles are reported,
+// unless the AllowMissing option is set.
+func (db *Database) Finish() error {
+	db.convertSuffixRules()
+	if db.options.AllowMissing {
+		return nil
+	}
+	for _, m := range db.Missing {
+		if !m.Optional {
+			return db.ReportMissing(m)
+		}
+	}
+	return nil
+}
+
+// ReportMissing writes that the given included makefile was not found, and returns
+// the error that there is no rule to make it
+func (db *Database) ReportMissing(m MissingMakefile) error {
+	db.message(m.Pos, "%s: No such file or directory", m.Name)
+	return parse.Diagnostics{{Severity: parse.Fatal, Message: fmt.Sprintf("No rule to make target '%s'", m.Name)}}
+}
+
+// MakefileNames returns the names of all makefiles that were read, and of the included
+// makefiles that were not found, in the order they were read or included
+func (db *Database) MakefileNames() []string {
+	return append([]string{}, db.names...)
+}
+
+// stdout returns where $(info ...) should write
+func (db *Database) stdout() io.Writer {
+	if db.options.Stdout != nil {
+		return db.options.Stdout
+	}
+	return os.Stdout
+}
+
+// stderr returns where warnings should be written
+func (db *Database) stderr() io.Writer {
+	if db.options.Stderr != nil {
+		return db.options.Stderr
+	}
+	return os.Stderr
+}
+
+// message writes a message to stderr, prefixed with the given position, as in "Makefile:3: message"
+func (db *Database) message(pos graph.Position, format string, args ...interface{}) {
+	d := &parse.Diagnostic{File: pos.File, Line: pos.Line}
+	fmt.Fprintf(db.stderr(), "%s: %s\n", d.Position(), fmt.Sprintf(format, args...))
+}
+
+// warn writes a warning to stderr, like "Makefile:7: warning: overriding recipe for target 'all'"
+func (db *Database) warn(pos graph.Position, format string, args ...interface{}) {
+	d := &parse.Diagnostic{File: pos.File, Line: pos.Line, Severity: parse.Warning, Message: fmt.Sprintf(format, args...)}
+	fmt.Fprintln(db.stderr(), d.Error())
+}
+
+// readFile reads a file from the file system given in the options, or from the OS file system
+func (db *Database) readFile(name string) ([]byte, error) {
+	if db.options.FS != nil {
+		return fs.ReadFile(db.options.FS, path.Clean(name))
+	}
+	return ioutil.ReadFile(name)
+}
+
+// exists checks if a file exists, in the file system given in the options, or in the OS file system
+func (db *Database) exists(name string) bool {
+	var err error
+	if db.options.FS != nil {
+		_, err = fs.Stat(db.options.FS, path.Clean(name))
+	} else {
+		_, err = os.Stat(name)
+	}
+	return err == nil
+}
+
+// glob returns the files matching the given pattern, as $(wildcard ...) does
+func (db *Database) glob(pattern string) []string {
+	if !strings.ContainsAny(pattern, "*?[") {
+		if db.exists(pattern) {
+			return []string{pattern}
+		}
+		return nil
+	}
+	var (
+		matches []string
+		err     error
+	)
+	if db.options.FS != nil {
+		matches, err = fs.Glob(db.options.FS, pattern)
+	} else {
+		matches, err = filepath.Glob(pattern)
+	}
+	if err != nil {
+		return nil
+	}
+	return matches
+}
+
+// lookup returns the variable with the given name, from the given scope or its parents.
+// $(.VARIABLES) is computed when it is used.
+func (db *Database) lookup(scope *Scope, name string) *Variable {
+	if name == ".VARIABLES" {
+		return &Variable{Name: name, Value: strings.Join(db.Globals.Names(), " "), Flavor: Simple, Origin: OriginDefault}
+	}
+	return scope.Lookup(name)
+}
+
+// Lookup returns the global variable with the given name, or nil if it is not defined
+func (db *Database) Lookup(name string) *Variable {
+	return db.lookup(db.Globals, name)
+}
+
+// Value returns the expanded value of the global variable with the given name,
+// or an empty string if it is not defined
+func (db *Database) Value(name string) (string, error) {
+	if db.Lookup(name) == nil {
+		return "", nil
+	}
+	return db.Expand("$("+name+")", nil, graph.Position{})
+}
+
+// DefaultGoal returns the target that should be made when no goals are given on the
+// command line. This is the value of .DEFAULT_GOAL, which is the first target in the
+// makefiles that is not a special target or a pattern rule, unless it has been set.
+// Returns an empty string if there is no default goal.
+func (db *Database) DefaultGoal() (string, error) {
+	value, err := db.Value(".DEFAULT_GOAL")
+	if err != nil {
+		return "", err
+	}
+	goals := strings.Fields(value)
+	if len(goals) > 1 {
+		return "", parse.Diagnostics{{Severity: parse.Fatal, Message: ".DEFAULT_GOAL contains more than one target"}}
+	}
+	if len(goals) == 0 {
+		return "", nil
+	}
+	return goals[0], nil
+}
+
+// TargetScope returns a scope with the target-specific and pattern-specific variables
+// for the target with the given name. The given parent scope is usually the global scope,
+// but can also be the scope of the target that the given target is a prerequisite of,
+// since target-specific variables are inherited by prerequisites.
+// If the parent is nil, the global scope is used.
+func (db *Database) TargetScope(name string, parent *Scope) *Scope {
+	if parent == nil {
+		parent = db.Globals
+	}
+	scope := parent
+	db.mut.Lock()
+	defer db.mut.Unlock()
+	// Pattern-specific variables with longer stems come first, so that the more specific patterns win
+	var matching []*patternScope
+	var stems []int
+	for _, ps := range db.patterns {
+		if stem, ok := graph.MatchPattern(ps.pattern, name); ok {
+			matching = append(matching, ps)
+			stems = append(stems, len(stem))
+		}
+	}
+	order := make([]int, len(matching))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return stems[order[i]] > stems[order[j]]
+	})
+	for _, i := range order {
+		scope = &Scope{vars: matching[i].scope.vars, exports: matching[i].scope.exports, parent: scope}
+	}
+	if ts, found := db.targets[name]; found {
+		scope = &Scope{vars: ts.vars, exports: ts.exports, parent: scope}
+	}
+	return scope
+}
+
+// targetScope returns the scope for variables that are specific to the given target
+// or pattern, creating it if needed. The parent of the returned scope is the global scope.
+func (db *Database) targetScope(name string) *Scope {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+	if graph.IsPattern(name) {
+		for _, ps := range db.patterns {
+			if ps.pattern == name {
+				return ps.scope
+			}
+		}
+		ps := &patternScope{name, NewScope(db.Globals)}
+		db.patterns = append(db.patterns, ps)
+		return ps.scope
+	}
+	scope, found := db.targets[name]
+	if !found {
+		scope = NewScope(db.Globals)
+		db.targets[name] = scope
+	}
+	return scope
+}
+
+// validName matches variable names that can be exported to the environment
+var validName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// exportFlag returns if the variable with the given name is exported in the given scope.
+// A target-specific "export" only applies to the scope of the target, and the "export" and
+// "unexport" in the makefile apply to all scopes. The last result is false if it is not marked.
+func (db *Database) exportFlag(scope *Scope, name string) (export, found bool) {
+	if export, found := scope.exportFlag(name); found {
+		return export, true
+	}
+	db.mut.Lock()
+	defer db.mut.Unlock()
+	export, found = db.exports[name]
+	return export, found
+}
+
+// exported checks if the given variable should be exported to the environment of recipes
+// that are run in the given scope. Variables from the environment stay exported when they
+// are assigned in a makefile, and "export" without arguments or .EXPORT_ALL_VARIABLES
+// exports all variables.
+func (db *Database) exported(scope *Scope, v *Variable) bool {
+	if export, found := db.exportFlag(scope, v.Name); found {
+		return export
+	}
+	db.mut.Lock()
+	exportAll := db.exportAll
+	_, fromEnvironment := db.environ[v.Name]
+	db.mut.Unlock()
+	switch v.Origin {
+	case OriginEnvironment, OriginEnvironmentOverride, OriginCommandLine:
+		return true
+	case OriginDefault, OriginAutomatic:
+		return false
+	}
+	if t := db.Graph.Lookup(".EXPORT_ALL_VARIABLES"); t != nil && t.IsTarget {
+		exportAll = true
+	}
+	return exportAll || fromEnvironment
+}
+
+// environment returns the environment for running commands with the given expander,
+// with the exported variables from all the scopes of the expander, expanded in its scope
+func (db *Database) environment(x *expander) []string {
+	var env []string
+	for _, name := range x.scope.allNames() {
+		v := x.scope.Lookup(name)
+		if v == nil || !validName.MatchString(name) || !db.exported(x.scope, v) {
+			continue
+		}
+		if name == "MAKELEVEL" {
+			env = append(env, name+"="+strconv.Itoa(db.level+1))
+			continue
+		}
+		if name == "SHELL" {
+			// Unless SHELL is exported explicitly, recipes get SHELL from the environment
+			if export, _ := db.exportFlag(x.scope, name); !export {
+				continue
+			}
+		}
+		env = append(env, name+"="+x.variable(name))
+	}
+	if export, _ := db.exportFlag(x.scope, "SHELL"); !export {
+		db.mut.Lock()
+		shell, found := db.environ["SHELL"]
+		db.mut.Unlock()
+		if found {
+			env = append(env, "SHELL="+shell)
+		}
+	}
+	return env
+}
+
+// Program returns the name that messages are prefixed with,
+// which is "make" for the top-level make, and "make[1]" for a sub-make
+func (db *Database) Program() string {
+	if db.level > 0 {
+		return fmt.Sprintf("make[%d]", db.level)
+	}
+	return "make"
+}
+
+// Environment returns the environment that commands should be run with, as "NAME=value"
+// strings. The exported variables are expanded in the given scope, or in the global scope if nil.
+func (db *Database) Environment(scope *Scope) (env []string, err error) {
+	if scope == nil {
+		scope = db.Globals
+	}
+	defer recoverFatal(&err)
+	return db.environment(db.newExpander(scope, graph.Position{})), nil
+}
+
+// pos returns the position of the given line in the makefile that is evaluated
+func (e *evaluator) pos(line int) graph.Position {
+	if e.line != 0 {
+		line = e.line
+	}
+	return graph.Position{File: e.file.Path, Line: line}
+}
+
+// fail stops the evaluation with a fatal error at the given line
+func (e *evaluator) fail(line int, format string, args ...interface{}) {
+	pos := e.pos(line)
+	panic(&fatal{&parse.Diagnostic{File: pos.File, Line: pos.Line, Severity: parse.Fatal, Message: fmt.Sprintf(format, args...)}})
+}
+
+// expand expands the given text in the global scope
+func (e *evaluator) expand(s string, line int) string {
+	return e.db.newExpander(e.db.Globals, e.pos(line)).expand(s)
+}
+
+// evaluate goes through the given nodes in order
+func (e *evaluator) evaluate(nodes []parse.Node) {
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *parse.Blank, *parse.Comment:
+			// Blank lines and comments do not end the recipe of the current rule
+		case *parse.Command:
+			e.addCommand(n.Cmd, n.Line)
+		case *parse.Assignment:
+			e.endRule()
+			scope := e.db.Globals
+			e.setExport(scope, n.Export, n.Name, n.Line)
+			e.assignWith(scope, n.Name, n.Op, n.Value, n.Override, n.Line)
+		case *parse.Define:
+			e.endRule()
+			if n.End == nil {
+				e.fail(n.Line, "missing 'endef', unterminated 'define'")
+			}
+			e.setExport(e.db.Globals, n.Export, n.Name, n.Line)
+			e.assignWith(e.db.Globals, n.Name, n.Op, n.Value(), n.Override, n.Line)
+		case *parse.Rule:
+			e.endRule()
+			e.evaluateRule(n)
+			e.evaluate(n.Recipe)
+		case *parse.Conditional:
+			e.evaluateConditional(n)
+		case *parse.Directive:
+			e.endRule()
+			e.evaluateDirective(n)
+		case *parse.Expression:
+			e.endRule()
+			e.evaluateExpression(n.Expr, n.Line)
+		case *parse.Invalid:
+			e.fail(n.Line, "%s", n.Message)
+		}
+	}
+}
+
+// setExport marks the variable with the given unexpanded name as exported in the given scope,
+// if export is true. Exports in the global scope apply to all scopes.
+func (e *evaluator) setExport(scope *Scope, export bool, name string, line int) {
+	if !export {
+		return
+	}
+	name = strings.TrimSpace(e.expand(name, line))
+	if scope != e.db.Globals {
+		scope.setExport(name, true)
+		return
+	}
+	e.db.mut.Lock()
+	e.db.exports[name] = true
+	e.db.mut.Unlock()
+}
+
+// assignWith expands the variable name and assigns the value, with the origin of the evaluator,
+// or with the override origin if override is true
+func (e *evaluator) assignWith(scope *Scope, name, op, value string, override bool, line int) {
+	origin := e.origin
+	if override {
+		origin = OriginOverride
+	}
+	saved := e.origin
+	e.origin = origin
+	e.assign(scope, strings.TrimSpace(e.expand(name, line)), op, value, e.pos(line))
+	e.origin = saved
+}
+
+// assign assigns a value to the variable with the given name, in the given scope,
+// with the given assignment operator. Assignments from an origin with lower priority
+// than the origin of the existing variable are ignored, like when a makefile assigns
+// to a variable that was given on the command line.
+func (e *evaluator) assign(scope *Scope, name, op, value string, pos graph.Position) {
+	db := e.db
+	if name == "" {
+		e.fail(pos.Line, "empty variable name")
+	}
+	existing := scope.Local(name)
+	if existing != nil && existing.Origin == OriginEnvironment && db.options.EnvironmentFirst && e.origin < OriginEnvironmentOverride {
+		// With -e, the value from the environment is kept, and it now overrides the makefile
+		kept := *existing
+		kept.Origin = OriginEnvironmentOverride
+		scope.Set(&kept)
+		return
+	}
+	if existing != nil && existing.Origin > e.origin {
+		return
+	}
+	x := db.newExpander(scope, pos)
+	v := &Variable{Name: name, Value: value, Flavor: Recursive, Origin: e.origin, Pos: pos}
+	switch op {
+	case ":=", "::=":
+		v.Flavor = Simple
+		v.Value = x.expand(value)
+	case "?=":
+		if db.lookup(scope, name) != nil {
+			return
+		}
+	case "!=":
+		v.Value, _ = db.shell(x, x.expand(value))
+	case "+=":
+		if existing == nil && scope != db.Globals {
+			// A target-specific "+=" appends to the value the variable has for the target
+			v.Append = true
+			if base := db.lookup(scope, name); base != nil && base.Flavor == Simple {
+				v.Value = x.expand(value)
+			}
+			break
+		}
+		if existing == nil {
+			break
+		}
+		v.Flavor = existing.Flavor
+		if existing.Flavor == Simple {
+			value = x.expand(value)
+		}
+		switch {
+		case existing.Value == "":
+			v.Value = value
+		case value == "":
+			v.Value = existing.Value
+		default:
+			v.Value = existing.Value + " " + value
+		}
+		if existing.Origin > v.Origin {
+			v.Origin = existing.Origin
+		}
+	}
+	scope.Set(v)
+}
+
+// evaluateRule evaluates a rule, which is either a target-specific variable, a pattern rule,
+// a static pattern rule or an explicit rule
+func (e *evaluator) evaluateRule(n *parse.Rule) {
+	targetText := e.expand(n.TargetText, n.Line)
+	names := graph.SplitNames(targetText)
+	if n.Variable != nil {
+		for _, name := range names {
+			scope := e.db.targetScope(name)
+			e.setExport(scope, n.Variable.Export, n.Variable.Name, n.Line)
+			e.assignWith(scope, n.Variable.Name, n.Variable.Op, n.Variable.Value, n.Variable.Override, n.Line)
+		}
+		return
+	}
+	prereqText := e.expand(n.PrereqText, n.Line)
+	// After .SECONDEXPANSION, the prerequisites may still have references, like "$(@D)/.dirstamp"
+	special := e.db.Graph.Lookup(".SECONDEXPANSION")
+	secondExpansion := special != nil && special.IsTarget
+	index := strings.IndexByte
+	if secondExpansion {
+		index = parse.IndexOutsideReferences
+	}
+	// A static pattern rule, like "$(OBJECTS): %.o: %.c"
+	targetPattern := ""
+	if pos := index(prereqText, ':'); pos != -1 {
+		targetPattern = strings.TrimSpace(prereqText[:pos])
+		prereqText = prereqText[pos+1:]
+		if !graph.IsPattern(targetPattern) {
+			e.fail(n.Line, "target pattern contains no '%%'")
+		}
+	}
+	orderOnlyText := ""
+	if pos := index(prereqText, '|'); pos != -1 {
+		prereqText, orderOnlyText = prereqText[:pos], prereqText[pos+1:]
+	}
+	normal, orderOnly := graph.SplitNames(prereqText), graph.SplitNames(orderOnlyText)
+	var deferred *graph.Deferred
+	if secondExpansion && strings.Contains(prereqText+orderOnlyText, "$") {
+		deferred = &graph.Deferred{Normal: prereqText, OrderOnly: orderOnlyText}
+		normal, orderOnly = nil, nil
+	}
+	context := &ruleContext{
+		doubleColon: n.DoubleColon,
+		prereqs:     make(map[*graph.Target][]*graph.Target),
+		deferred:    make(map[*graph.Target]*graph.Deferred),
+	}
+	e.rule = context
+	if len(names) == 0 {
+		// For example "$(EMPTY): foo", where the recipe is ignored
+		return
+	}
+	// A pattern rule, like "%.o: %.c"
+	if targetPattern == "" && graph.IsPattern(names[0]) {
+		for _, name := range names {
+			if !graph.IsPattern(name) {
+				e.fail(n.Line, "mixed implicit and normal rules")
+			}
+		}
+		rule := &graph.PatternRule{Targets: names, Normal: normal, OrderOnly: orderOnly, Deferred: deferred, Terminal: n.DoubleColon, Builtin: e.builtin, Pos: e.pos(n.Line)}
+		e.db.removePatternRule(rule)
+		e.db.addPatternRule(rule)
+		context.pattern = rule
+	} else {
+		for _, name := range names {
+			if graph.IsPattern(name) && targetPattern == "" {
+				e.fail(n.Line, "mixed implicit and normal rules")
+			}
+			targetNormal, targetOrderOnly := normal, orderOnly
+			var targetDeferred *graph.Deferred
+			if deferred != nil {
+				// Each target has its own copy, since the stem and the prerequisites differ
+				copied := *deferred
+				targetDeferred = &copied
+			}
+			if targetPattern != "" {
+				stem, ok := graph.MatchPattern(targetPattern, name)
+				if !ok {
+					e.db.message(e.pos(n.Line), "target '%s' doesn't match the target pattern", name)
+				} else {
+					targetNormal = substituteStem(normal, stem)
+					targetOrderOnly = substituteStem(orderOnly, stem)
+					if targetDeferred != nil {
+						targetDeferred.Stem = stem
+					}
+				}
+			}
+			e.addTarget(context, name, targetNormal, targetOrderOnly, targetDeferred, n.Line)
+		}
+	}
+	if n.Command != nil {
+		e.addCommand(n.Command.Cmd, n.Line)
+	}
+}
+
+// substituteStem replaces the first "%" in each of the given prerequisites with the stem
+func substituteStem(prereqs []string, stem string) []string {
+	result := make([]string, len(prereqs))
+	for i, p := range prereqs {
+		result[i] = graph.Substitute(p, stem)
+	}
+	return result
+}
+
+// addTarget adds a target from an explicit rule, with the given prerequisites, and the
+// prerequisites that are expanded a second time, if any
+func (e *evaluator) addTarget(context *ruleContext, name string, normal, orderOnly []string, deferred *graph.Deferred, line int) {
+	g := e.db.Graph
+	t := g.AddTarget(name)
+	if t.IsTarget && t.DoubleColon != context.doubleColon {
+		e.fail(line, "target file '%s' has both : and :: entries", name)
+	}
+	if !t.IsTarget {
+		t.IsTarget = true
+		t.DoubleColon = context.doubleColon
+		t.Pos = e.pos(line)
+		e.setDefaultGoal(name)
+	}
+	normalTargets := make([]*graph.Target, len(normal))
+	for i, p := range normal {
+		normalTargets[i] = g.AddTarget(p)
+		t.AddNormal(normalTargets[i])
+	}
+	orderOnlyTargets := make([]*graph.Target, len(orderOnly))
+	for i, p := range orderOnly {
+		orderOnlyTargets[i] = g.AddTarget(p)
+		t.AddOrderOnly(orderOnlyTargets[i])
+	}
+	if context.doubleColon {
+		rule := &graph.Rule{Normal: normalTargets, OrderOnly: orderOnlyTargets, Deferred: deferred, Pos: e.pos(line)}
+		t.Rules = append(t.Rules, rule)
+		context.rules = append(context.rules, rule)
+	} else if deferred != nil {
+		t.Deferred = append(t.Deferred, deferred)
+	}
+	if deferred != nil {
+		context.deferred[t] = deferred
+	}
+	context.targets = append(context.targets, t)
+	context.prereqs[t] = normalTargets
+	e.db.special(t, normalTargets)
+}
+
+// setDefaultGoal sets .DEFAULT_GOAL to the given target, if it is not already set
+// and the target is not a special target like ".PHONY" or a pattern
+func (e *evaluator) setDefaultGoal(name string) {
+	if e.builtin || (strings.HasPrefix(name, ".") && !strings.Contains(name, "/")) || graph.IsPattern(name) {
+		return
+	}
+	if v := e.db.Globals.Local(".DEFAULT_GOAL"); v != nil && v.Value != "" {
+		return
+	}
+	e.db.Globals.Set(&Variable{Name: ".DEFAULT_GOAL", Value: name, Flavor: Simple, Origin: OriginFile})
+}
+
+// addCommand adds a recipe line to the current rule. The recipe is created when the first
+// line is added. If a target already has a recipe, it is replaced, with a warning.
+func (e *evaluator) addCommand(text string, line int) {
+	context := e.rule
+	if context == nil {
+		e.fail(line, "recipe commences before first target")
+	}
+	command := graph.Command{Text: text, Pos: e.pos(line)}
+	if context.recipe != nil {
+		context.recipe.Commands = append(context.recipe.Commands, command)
+		return
+	}
+	recipe := &graph.Recipe{Commands: []graph.Command{command}, Pos: command.Pos}
+	context.recipe = recipe
+	if context.pattern != nil {
+		context.pattern.Recipe = recipe
+		return
+	}
+	for i, t := range context.targets {
+		if context.doubleColon {
+			context.rules[i].Recipe = recipe
+			continue
+		}
+		if t.Recipe != nil {
+			e.db.warn(recipe.Pos, "overriding recipe for target '%s'", t.Name)
+			e.db.warn(t.Recipe.Pos, "ignoring old recipe for target '%s'", t.Name)
+		}
+		t.Recipe = recipe
+		// The prerequisites of the rule with the recipe come first, so that the first one is $<
+		t.PrependNormal(context.prereqs[t])
+		if d := context.deferred[t]; d != nil {
+			d.Recipe = true
+		}
+	}
+}
+
+// endRule ends the current rule, so that no more recipe lines can be added to it.
+// A pattern rule without a recipe cancels any existing pattern rule with the same
+// targets and prerequisites.
+func (e *evaluator) endRule() {
+	if e.rule != nil && e.rule.pattern != nil && e.rule.recipe == nil {
+		e.db.removePatternRule(e.rule.pattern)
+	}
+	e.rule = nil
+}
+
+// addPatternRule adds a pattern rule after the other rules from makefiles, but before the
+// built-in rules, since GNU Make defines the built-in rules after reading the makefiles
+// and rules that come first are preferred
+func (db *Database) addPatternRule(rule *graph.PatternRule) {
+	rules := db.Graph.PatternRules
+	i := len(rules)
+	if !rule.Builtin {
+		for i > 0 && rules[i-1].Builtin {
+			i--
+		}
+	}
+	rules = append(rules, nil)
+	copy(rules[i+1:], rules[i:])
+	rules[i] = rule
+	db.Graph.PatternRules = rules
+}
+
+// removePatternRule removes all pattern rules with the same targets and prerequisites as the given one
+func (db *Database) removePatternRule(rule *graph.PatternRule) {
+	rules := db.Graph.PatternRules[:0]
+	for _, r := range db.Graph.PatternRules {
+		if !equalStrings(r.Targets, rule.Targets) || !equalStrings(r.Normal, rule.Normal) || deferredText(r) != deferredText(rule) {
+			rules = append(rules, r)
+		}
+	}
+	db.Graph.PatternRules = rules
+}
+
+// deferredText returns the prerequisites of a pattern rule that are expanded a second time,
+// or an empty string if there are none
+func deferredText(rule *graph.PatternRule) string {
+	if rule.Deferred == nil {
+		return ""
+	}
+	return rule.Deferred.Normal + "|" + rule.Deferred.OrderOnly
+}
+
+// equalStrings checks if two slices of strings are equal
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluateConditional evaluates the branches of a conditional, until a condition is true,
+// and then evaluates the nodes in that branch
+func (e *evaluator) evaluateConditional(c *parse.Conditional) {
+	for _, branch := range c.Branches {
+		d := branch.Directive
+		name, args := d.Name, d.Args
+		if name == "else" {
+			if strings.TrimSpace(stripComment(args)) == "" {
+				e.evaluate(branch.Nodes)
+				return
+			}
+			// "else ifeq (a,b)" and the like
+			fields := strings.Fields(args)
+			name = fields[0]
+			if pos := strings.Index(name, "("); pos != -1 {
+				name = name[:pos]
+			}
+			args = strings.TrimSpace(args[len(name):])
+			if name != "ifeq" && name != "ifneq" && name != "ifdef" && name != "ifndef" {
+				e.fail(d.Line, "extraneous text after 'else' directive")
+			}
+		}
+		if e.condition(name, args, d.Line) {
+			e.evaluate(branch.Nodes)
+			return
+		}
+	}
+}
+
+// stripComment removes a "# comment" from the end of a directive line
+func stripComment(s string) string {
+	if pos := parse.IndexOutsideReferences(s, '#'); pos != -1 {
+		return s[:pos]
+	}
+	return s
+}
+
+// condition checks if the condition of an "ifeq", "ifneq", "ifdef" or "ifndef" directive is true
+func (e *evaluator) condition(name, args string, line int) bool {
+	args = strings.TrimSpace(stripComment(args))
+	switch name {
+	case "ifdef", "ifndef":
+		variable := strings.TrimSpace(e.expand(args, line))
+		v := e.db.lookup(e.db.Globals, variable)
+		defined := v != nil && v.Value != ""
+		return defined == (name == "ifdef")
+	}
+	a, b, ok := conditionArgs(args)
+	if !ok {
+		e.fail(line, "invalid syntax in conditional")
+	}
+	equal := e.expand(a, line) == e.expand(b, line)
+	return equal == (name == "ifeq")
+}
+
+// conditionArgs splits the arguments of "ifeq" and "ifneq", which are given
+// as "(a,b)", "'a' 'b'" or "\"a\" \"b\"". Trailing whitespace is removed from the
+// first argument and leading whitespace from the second, when using parentheses.
+func conditionArgs(args string) (string, string, bool) {
+	if strings.HasPrefix(args, "(") {
+		end := findClosing(args, 0)
+		if end != len(args)-1 {
+			return "", "", false
+		}
+		parts := splitArgs(args[1:end], 2)
+		if len(parts) != 2 {
+			return "", "", false
+		}
+		return strings.TrimRight(parts[0], " \t"), strings.TrimLeft(parts[1], " \t"), true
+	}
+	var quoted []string
+	for len(args) > 0 && len(quoted) < 2 {
+		quote := args[0]
+		if quote != '"' && quote != '\'' {
+			return "", "", false
+		}
+		end := strings.IndexByte(args[1:], quote)
+		if end == -1 {
+			return "", "", false
+		}
+		quoted = append(quoted, args[1:end+1])
+		args = strings.TrimLeft(args[end+2:], " \t")
+	}
+	if len(quoted) != 2 || args != "" {
+		return "", "", false
+	}
+	return quoted[0], quoted[1], true
+}
+
+// evaluateDirective evaluates directives like "include", "export" and "undefine"
+func (e *evaluator) evaluateDirective(d *parse.Directive) {
+	db := e.db
+	args := strings.TrimSpace(stripComment(d.Args))
+	switch d.Name {
+	case "include", "-include", "sinclude":
+		for _, name := range strings.Fields(e.expand(args, d.Line)) {
+			e.include(name, d.Name == "include", d.Line)
+		}
+	case "export", "unexport":
+		export := d.Name == "export"
+		names := strings.Fields(e.expand(args, d.Line))
+		db.mut.Lock()
+		if len(names) == 0 {
+			db.exportAll = export
+		}
+		for _, name := range names {
+			db.exports[name] = export
+		}
+		db.mut.Unlock()
+	case "undefine":
+		e.undefine(args, false, d.Line)
+	case "override":
+		if fields := strings.Fields(args); len(fields) > 0 && fields[0] == "undefine" {
+			e.undefine(strings.TrimSpace(args[len("undefine"):]), true, d.Line)
+			return
+		}
+		e.fail(d.Line, "missing separator")
+	case "vpath":
+		// vpath is not supported yet, files are only looked for in the current directory
+	}
+}
+
+// undefine removes a global variable, unless it has an origin with a higher priority
+func (e *evaluator) undefine(args string, override bool, line int) {
+	origin := e.origin
+	if override {
+		origin = OriginOverride
+	}
+	for _, name := range strings.Fields(e.expand(args, line)) {
+		if v := e.db.Globals.Local(name); v != nil && v.Origin <= origin {
+			e.db.Globals.Delete(name)
+		}
+	}
+}
+
+// include reads and evaluates an included makefile. Relative paths that are not found
+// are searched for in the include directories. Missing makefiles are remembered and
+// reported by Finish, unless they are optional.
+func (e *evaluator) include(name string, required bool, line int) {
+	db := e.db
+	if db.options.Verbose {
+		dontCare := ""
+		if !required {
+			dontCare = " (don't care)"
+		}
+		fmt.Fprintf(db.stdout(), "Reading makefile '%s' (search path)%s (no ~ expansion)...\n", name, dontCare)
+	}
+	found := name
+	if !db.exists(name) && !filepath.IsAbs(name) {
+		for _, dir := range db.includeDirs() {
+			if candidate := filepath.Join(dir, name); db.exists(candidate) {
+				found = candidate
+				break
+			}
+		}
+	}
+	data, err := db.readFile(found)
+	if err != nil {
+		db.Missing = append(db.Missing, MissingMakefile{Name: name, Pos: e.pos(line), Optional: !required})
+		db.names = append(db.names, name)
+		return
+	}
+	db.read(parse.ParseString(found, string(data)))
+}
+
+// evaluateExpression expands a line that could only be interpreted after expansion,
+// like "$(RULES)" or "$(eval ...)", and evaluates the result as makefile text
+func (e *evaluator) evaluateExpression(text string, line int) {
+	expanded := e.expand(text, line)
+	if strings.TrimSpace(expanded) == "" {
+		return
+	}
+	file := parse.ParseString(e.file.Path, expanded)
+	saved := e.line
+	e.line = e.pos(line).Line
+	e.evaluate(file.Nodes)
+	e.line = saved
+}
+
+// convertSuffixRules turns old-fashioned suffix rules, like ".c.o:", into pattern rules,
+// like "%.o: %.c". A suffix rule is a target that consists of one or two known suffixes,
+// with a recipe and no prerequisites.
+func (db *Database) convertSuffixRules() {
+	known := make(map[string]bool, len(db.Suffixes))
+	for _, suffix := range db.Suffixes {
+		known[suffix] = true
+	}
+	for _, t := range db.Graph.Targets() {
+		if t.Recipe == nil || len(t.Normal) > 0 || !strings.HasPrefix(t.Name, ".") {
+			continue
+		}
+		var rule *graph.PatternRule
+		if known[t.Name] {
+			rule = &graph.PatternRule{Targets: []string{"%"}, Normal: []string{"%" + t.Name}}
+		} else {
+			for _, suffix := range db.Suffixes {
+				if strings.HasPrefix(t.Name, suffix) && known[t.Name[len(suffix):]] {
+					rule = &graph.PatternRule{Targets: []string{"%" + t.Name[len(suffix):]}, Normal: []string{"%" + suffix}}
+					break
+				}
+			}
+		}
+		if rule == nil {
+			continue
+		}
+		rule.Recipe = t.Recipe
+		rule.Pos = t.Pos
+		db.removePatternRule(rule)
+		db.Graph.PatternRules = append(db.Graph.PatternRules, rule)
+	}
+}
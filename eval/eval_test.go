@@ -0,0 +1,115 @@
+package eval
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// loadString loads a makefile with the given text as "Makefile", and fails the test if it
+// can not be loaded. Messages are written to the returned buffer.
+func loadString(t *testing.T, options Options, text string) (*Database, *bytes.Buffer) {
+	t.Helper()
+	var out bytes.Buffer
+	options.FS = fstest.MapFS{"Makefile": {Data: []byte(text)}}
+	options.Stdout, options.Stderr = &out, &out
+	db, err := Load(options, "Makefile")
+	if err != nil {
+		t.Fatalf("%v, the output is %q", err, out.String())
+	}
+	return db, &out
+}
+
+// generatedMakefile returns a makefile with the given number of rules, each with a recipe
+func generatedMakefile(rules int) string {
+	var sb strings.Builder
+	sb.WriteString("CC = gcc\nCFLAGS = -O2\n\nall: target0\n\n")
+	for i := 0; i < rules; i++ {
+		fmt.Fprintf(&sb, "target%d: target%d.c dep%d.h\n\t$(CC) $(CFLAGS) -o $@ $<\n\n", i, i, i%100)
+	}
+	return sb.String()
+}
+
+// BenchmarkParse50k parses and evaluates a makefile with 50,000 rules
+func BenchmarkParse50k(b *testing.B) {
+	fsys := fstest.MapFS{"Makefile": {Data: []byte(generatedMakefile(50000))}}
+	options := Options{FS: fsys, Stdout: ioutil.Discard, Stderr: ioutil.Discard}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db, err := Load(options, "Makefile")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if db.Graph.Lookup("target49999") == nil {
+			b.Fatal("the last target is missing")
+		}
+	}
+}
+
+// BenchmarkParseWide50k parses and evaluates a makefile with a rule with 50,000 prerequisites
+func BenchmarkParseWide50k(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString("all:")
+	for i := 0; i < 50000; i++ {
+		fmt.Fprintf(&sb, " target%d", i)
+	}
+	sb.WriteString("\n\ntarget%:\n\t@:\n")
+	fsys := fstest.MapFS{"Makefile": {Data: []byte(sb.String())}}
+	options := Options{FS: fsys, Stdout: ioutil.Discard, Stderr: ioutil.Discard}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db, err := Load(options, "Makefile")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if all := db.Graph.Lookup("all"); all == nil || len(all.Normal) != 50000 {
+			b.Fatal("the prerequisites of all are missing")
+		}
+	}
+}
+
+// TestEval checks that the --eval strings are evaluated in order, before the makefiles
+func TestEval(t *testing.T) {
+	const makefile = "X ?= file\nY = $(X)-y\nall:\n\t@echo\n"
+	for _, test := range []struct {
+		eval              []string
+		x, z, defaultGoal string
+	}{
+		{nil, "file", "", "all"},
+		{[]string{"X = eval", "Z = $(X)z"}, "eval", "evalz", "all"},
+		{[]string{"X = a", "X += b"}, "a b", "", "all"},
+		{[]string{"first: ; @echo first"}, "file", "", "first"},
+	} {
+		db, _ := loadString(t, Options{Eval: test.eval}, makefile)
+		x, _ := db.Value("X")
+		z, _ := db.Value("Z")
+		goal, err := db.DefaultGoal()
+		if err != nil || x != test.x || z != test.z || goal != test.defaultGoal {
+			t.Errorf("%q: $(X) is %q, $(Z) is %q and the default goal is %q, want %q, %q and %q",
+				test.eval, x, z, goal, test.x, test.z, test.defaultGoal)
+		}
+		// The --eval strings are not makefiles
+		if list, _ := db.Value("MAKEFILE_LIST"); strings.TrimSpace(list) != "Makefile" {
+			t.Errorf("%q: $(MAKEFILE_LIST) is %q", test.eval, list)
+		}
+	}
+}
+
+// TestWarnUndefined checks the warnings for references to undefined variables,
+// which have the line of the reference
+func TestWarnUndefined(t *testing.T) {
+	const makefile = "X = $(UNDEF1)\nY := $(UNDEF2) $(X)\nDEF =\nZ := $(DEF)$(origin NONE)\n" +
+		"ifeq ($(UNDEF3),)\nendif\nall:\n\t@echo $(UNDEF4)\n"
+	_, out := loadString(t, Options{WarnUndefined: true}, makefile)
+	want := "Makefile:2: warning: undefined variable 'UNDEF2'\nMakefile:2: warning: undefined variable 'UNDEF1'\n" +
+		"Makefile:5: warning: undefined variable 'UNDEF3'\n"
+	if out.String() != want {
+		t.Errorf("the output is %q, want %q", out.String(), want)
+	}
+	if _, out := loadString(t, Options{}, makefile); out.Len() != 0 {
+		t.Errorf("without the option, the output is %q", out.String())
+	}
+}
@@ -0,0 +1,250 @@
+package eval
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xyproto/ake/graph"
+	"github.com/xyproto/ake/parse"
+)
+
+// fatal is used for panicking when expansion can not continue, like for $(error ...).
+// It is recovered by the exported functions of this package and returned as an error.
+type fatal struct {
+	diagnostic *parse.Diagnostic
+}
+
+// expander expands variable references and function calls in a string.
+// A new expander is used for each expansion, so that expansions may
+// happen concurrently, for instance when running recipes in parallel.
+type expander struct {
+	db        *Database
+	scope     *Scope          // where variables are looked up
+	pos       graph.Position  // where the text that is expanded comes from, for error messages
+	expanding map[string]bool // recursive variables that are being expanded, to detect loops
+}
+
+// newExpander creates an expander that looks up variables in the given scope
+func (db *Database) newExpander(scope *Scope, pos graph.Position) *expander {
+	return &expander{db: db, scope: scope, pos: pos, expanding: make(map[string]bool)}
+}
+
+// fail stops the expansion with a fatal error at the current position
+func (x *expander) fail(format string, args ...interface{}) {
+	panic(&fatal{&parse.Diagnostic{File: x.pos.File, Line: x.pos.Line, Severity: parse.Fatal, Message: fmt.Sprintf(format, args...)}})
+}
+
+// closing returns the closing parenthesis or brace for the given opening one
+func closing(open byte) byte {
+	if open == '{' {
+		return '}'
+	}
+	return ')'
+}
+
+// findClosing returns the index of the parenthesis or brace that closes the one at the given index.
+// Returns -1 if it is not found.
+func findClosing(s string, start int) int {
+	open := s[start]
+	close := closing(open)
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitArgs splits the arguments of a function call at commas that are not within parentheses
+// or braces. At most max arguments are returned, so that the last argument keeps any further commas.
+// If max is 0, there is no limit.
+func splitArgs(s string, max int) []string {
+	var args []string
+	depth := 0
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case ',':
+			if depth == 0 && (max == 0 || len(args) < max-1) {
+				args = append(args, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(args, s[start:])
+}
+
+// expand expands all variable references and function calls in the given string
+func (x *expander) expand(s string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			// A "$" at the end expands to nothing
+			break
+		}
+		switch c := s[i+1]; c {
+		case '$':
+			sb.WriteByte('$')
+			i++
+		case '(', '{':
+			end := findClosing(s, i+1)
+			if end == -1 {
+				x.fail("unterminated variable reference")
+			}
+			sb.WriteString(x.reference(s[i+2:end], c))
+			i = end
+		default:
+			sb.WriteString(x.variable(string(c)))
+			i++
+		}
+	}
+	return sb.String()
+}
+
+// reference expands what is within "$(" and ")", which is either a function call,
+// a substitution reference like "$(SRC:.c=.o)" or a variable reference
+func (x *expander) reference(content string, open byte) string {
+	// Is this a function call?
+	if end := strings.IndexAny(content, " \t"); end > 0 {
+		if f, found := functions[content[:end]]; found {
+			return x.call(content[:end], f, strings.TrimLeft(content[end:], " \t"))
+		}
+	}
+	// Is this a substitution reference?
+	if colon := parse.IndexOutsideReferences(content, ':'); colon != -1 {
+		if eq := strings.Index(content[colon:], "="); eq != -1 {
+			name := x.expand(content[:colon])
+			from := x.expand(content[colon+1 : colon+eq])
+			to := x.expand(content[colon+eq+1:])
+			if !strings.Contains(from, "%") {
+				from, to = "%"+from, "%"+to
+			}
+			return patsubst(from, to, x.variable(name))
+		}
+	}
+	return x.variable(x.expand(content))
+}
+
+// variable returns the expanded value of the variable with the given name
+func (x *expander) variable(name string) string {
+	v := x.db.lookup(x.scope, name)
+	if v == nil {
+		x.undefined(name)
+		return ""
+	}
+	if v.Flavor != Recursive {
+		return v.Value
+	}
+	if x.expanding[name] {
+		if v.Pos.File != "" {
+			// The error is reported where the variable was defined
+			x.pos = v.Pos
+		}
+		x.fail("Recursive variable '%s' references itself (eventually)", name)
+	}
+	x.expanding[name] = true
+	value := x.expand(v.Value)
+	delete(x.expanding, name)
+	return value
+}
+
+// undefined warns that the variable with the given name is referenced but not defined,
+// if the WarnUndefined option is set
+func (x *expander) undefined(name string) {
+	if x.db.options.WarnUndefined {
+		x.db.warn(x.pos, "undefined variable '%s'", name)
+	}
+}
+
+// call calls the given function with the unexpanded arguments
+func (x *expander) call(name string, f *function, args string) string {
+	var argv []string
+	if args != "" || f.minArgs > 0 {
+		argv = splitArgs(args, f.maxArgs)
+	}
+	if len(argv) < f.minArgs {
+		x.fail("insufficient number of arguments (%d) to function '%s'", len(argv), name)
+	}
+	if f.expandArgs {
+		for i, arg := range argv {
+			argv[i] = x.expand(arg)
+		}
+	}
+	return f.call(x, argv)
+}
+
+// recoverFatal recovers from a panic with a *fatal and stores the diagnostic in the given error
+func recoverFatal(err *error) {
+	if r := recover(); r != nil {
+		f, ok := r.(*fatal)
+		if !ok {
+			panic(r)
+		}
+		*err = parse.Diagnostics{f.diagnostic}
+	}
+}
+
+// Expand expands all variable references and function calls in the given string,
+// looking up variables in the given scope, or in the global scope if it is nil.
+// The given position is used in error messages.
+func (db *Database) Expand(s string, scope *Scope, pos graph.Position) (result string, err error) {
+	if scope == nil {
+		scope = db.Globals
+	}
+	defer recoverFatal(&err)
+	return db.newExpander(scope, pos).expand(s), nil
+}
+
+// ExpandDeferred expands prerequisites a second time, as with .SECONDEXPANSION, in the given
+// scope, where the automatic variables of the target should be set. For pattern rules and
+// static pattern rules, the first "%" of each word is replaced by "$*" before the expansion,
+// so that the stem is substituted without being expanded itself, as GNU Make does.
+// The given position is used in error messages.
+func (db *Database) ExpandDeferred(d *graph.Deferred, scope *Scope, pos graph.Position, pattern bool) (normal, orderOnly []string, err error) {
+	defer recoverFatal(&err)
+	x := db.newExpander(scope, pos)
+	expand := func(text string) []string {
+		if pattern {
+			text = stemReferences(text)
+		}
+		return graph.SplitNames(x.expand(text))
+	}
+	return expand(d.Normal), expand(d.OrderOnly), nil
+}
+
+// stemReferences replaces the first "%" of each word in the given text with "$*"
+func stemReferences(text string) string {
+	var sb strings.Builder
+	replaced := false
+	for _, r := range text {
+		switch {
+		case r == ' ' || r == '\t':
+			replaced = false
+			sb.WriteRune(r)
+		case r == '%' && !replaced:
+			replaced = true
+			sb.WriteString("$*")
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
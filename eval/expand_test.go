@@ -0,0 +1,49 @@
+package eval
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestSecondExpansion checks that the prerequisites of rules after .SECONDEXPANSION keep
+// the references that were escaped with "$$", to be expanded again when they are made
+func TestSecondExpansion(t *testing.T) {
+	const makefile = "all: out/x.o\nout/x.o: $$(@D)/.dirstamp $(A) | $$(B)\n.SECONDEXPANSION:\n" +
+		"A = a\nB = b\nlib/y.o: $$(@D)/.dirstamp $(A) | $$(B)\nlib/z.o: %.o: $$*.c\n"
+	db, _ := loadString(t, Options{}, makefile)
+	if d := db.Graph.Lookup("out/x.o").Deferred; len(d) != 0 {
+		t.Errorf("the rule before .SECONDEXPANSION has deferred prerequisites %+v", d[0])
+	}
+	for _, test := range []struct {
+		target, normal, orderOnly, stem string
+	}{
+		{"lib/y.o", "$(@D)/.dirstamp a", "$(B)", ""},
+		{"lib/z.o", "$*.c", "", "lib/z"},
+	} {
+		deferred := db.Graph.Lookup(test.target).Deferred
+		if len(deferred) != 1 {
+			t.Errorf("%s: the deferred prerequisites are %+v", test.target, deferred)
+			continue
+		}
+		// The text is split into names after the second expansion, so the spaces do not matter
+		d := deferred[0]
+		normal, orderOnly := strings.Join(strings.Fields(d.Normal), " "), strings.Join(strings.Fields(d.OrderOnly), " ")
+		if normal != test.normal || orderOnly != test.orderOnly || d.Stem != test.stem {
+			t.Errorf("%s: the deferred prerequisites are %+v", test.target, *d)
+		}
+	}
+}
+
+// TestStemReferences checks that the first "%" of each word becomes a reference to the stem
+func TestStemReferences(t *testing.T) {
+	for text, want := range map[string]string{
+		"%.c":             "$*.c",
+		"%.c %.h":         "$*.c $*.h",
+		"%/%.c":           "$*/%.c",
+		"$(@D)/.dirstamp": "$(@D)/.dirstamp",
+	} {
+		if got := stemReferences(text); got != want {
+			t.Errorf("%q: got %q, want %q", text, got, want)
+		}
+	}
+}
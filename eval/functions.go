@@ -0,0 +1,524 @@
+package eval
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xyproto/ake/parse"
+)
+
+// function is a built-in make function, like $(subst from,to,text)
+type function struct {
+	minArgs    int  // the minimum number of arguments
+	maxArgs    int  // the maximum number of arguments, or 0 for no limit; the last argument gets any extra commas
+	expandArgs bool // expand all arguments before calling, instead of leaving it to the function
+	call       func(x *expander, args []string) string
+}
+
+// functions are all the built-in functions, by name
+var functions map[string]*function
+
+func init() {
+	functions = map[string]*function{
+		"subst":      {3, 3, true, fnSubst},
+		"patsubst":   {3, 3, true, fnPatsubst},
+		"strip":      {1, 1, true, fnStrip},
+		"findstring": {2, 2, true, fnFindstring},
+		"filter":     {2, 2, true, fnFilter},
+		"filter-out": {2, 2, true, fnFilterOut},
+		"sort":       {1, 1, true, fnSort},
+		"word":       {2, 2, true, fnWord},
+		"wordlist":   {3, 3, true, fnWordlist},
+		"words":      {1, 1, true, fnWords},
+		"firstword":  {1, 1, true, fnFirstword},
+		"lastword":   {1, 1, true, fnLastword},
+		"dir":        {1, 1, true, fnDir},
+		"notdir":     {1, 1, true, fnNotdir},
+		"suffix":     {1, 1, true, fnSuffix},
+		"basename":   {1, 1, true, fnBasename},
+		"addsuffix":  {2, 2, true, fnAddsuffix},
+		"addprefix":  {2, 2, true, fnAddprefix},
+		"join":       {2, 2, true, fnJoin},
+		"wildcard":   {1, 1, true, fnWildcard},
+		"realpath":   {1, 1, true, fnRealpath},
+		"abspath":    {1, 1, true, fnAbspath},
+		"error":      {1, 1, true, fnError},
+		"warning":    {1, 1, true, fnWarning},
+		"info":       {1, 1, true, fnInfo},
+		"shell":      {1, 1, true, fnShell},
+		"origin":     {1, 1, true, fnOrigin},
+		"flavor":     {1, 1, true, fnFlavor},
+		"value":      {1, 1, true, fnValue},
+		"eval":       {1, 1, true, fnEval},
+		"file":       {1, 2, true, fnFile},
+		"call":       {1, 0, true, fnCall},
+		"foreach":    {3, 3, false, fnForeach},
+		"if":         {2, 3, false, fnIf},
+		"or":         {1, 0, false, fnOr},
+		"and":        {1, 0, false, fnAnd},
+	}
+}
+
+// patsubst replaces words matching the pattern "from" with "to", where "%" in both
+// stands for the same stem. Only the first "%" in each is special.
+func patsubst(from, to, text string) string {
+	words := strings.Fields(text)
+	pos := strings.Index(from, "%")
+	for i, word := range words {
+		if pos == -1 {
+			if word == from {
+				words[i] = to
+			}
+			continue
+		}
+		prefix, suffix := from[:pos], from[pos+1:]
+		if len(word) >= len(prefix)+len(suffix) && strings.HasPrefix(word, prefix) && strings.HasSuffix(word, suffix) {
+			stem := word[len(prefix) : len(word)-len(suffix)]
+			words[i] = strings.Replace(to, "%", stem, 1)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// matchesAny checks if the word matches any of the given patterns, where "%" matches any stem
+func matchesAny(patterns []string, word string) bool {
+	for _, pattern := range patterns {
+		pos := strings.Index(pattern, "%")
+		if pos == -1 {
+			if pattern == word {
+				return true
+			}
+			continue
+		}
+		prefix, suffix := pattern[:pos], pattern[pos+1:]
+		if len(word) >= len(prefix)+len(suffix) && strings.HasPrefix(word, prefix) && strings.HasSuffix(word, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// mapWords calls the given function for each word and joins the non-empty results with spaces
+func mapWords(text string, f func(string) string) string {
+	words := strings.Fields(text)
+	result := make([]string, 0, len(words))
+	for _, word := range words {
+		if w := f(word); w != "" {
+			result = append(result, w)
+		}
+	}
+	return strings.Join(result, " ")
+}
+
+func fnSubst(x *expander, args []string) string {
+	if args[0] == "" {
+		return args[2]
+	}
+	return strings.Replace(args[2], args[0], args[1], -1)
+}
+
+func fnPatsubst(x *expander, args []string) string {
+	return patsubst(args[0], args[1], args[2])
+}
+
+func fnStrip(x *expander, args []string) string {
+	return strings.Join(strings.Fields(args[0]), " ")
+}
+
+func fnFindstring(x *expander, args []string) string {
+	if strings.Contains(args[1], args[0]) {
+		return args[0]
+	}
+	return ""
+}
+
+func fnFilter(x *expander, args []string) string {
+	patterns := strings.Fields(args[0])
+	return mapWords(args[1], func(word string) string {
+		if matchesAny(patterns, word) {
+			return word
+		}
+		return ""
+	})
+}
+
+func fnFilterOut(x *expander, args []string) string {
+	patterns := strings.Fields(args[0])
+	return mapWords(args[1], func(word string) string {
+		if matchesAny(patterns, word) {
+			return ""
+		}
+		return word
+	})
+}
+
+func fnSort(x *expander, args []string) string {
+	words := strings.Fields(args[0])
+	sort.Strings(words)
+	unique := words[:0]
+	for i, word := range words {
+		if i == 0 || word != words[i-1] {
+			unique = append(unique, word)
+		}
+	}
+	return strings.Join(unique, " ")
+}
+
+// number parses a numeric argument to a function, and stops with an error if it is not a number
+func (x *expander) number(s, function, which string) int {
+	s = strings.TrimSpace(s)
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		x.fail("non-numeric %s argument to '%s' function: '%s'", which, function, s)
+	}
+	return n
+}
+
+func fnWord(x *expander, args []string) string {
+	n := x.number(args[0], "word", "first")
+	if n < 1 {
+		x.fail("first argument to 'word' function must be greater than 0")
+	}
+	words := strings.Fields(args[1])
+	if n > len(words) {
+		return ""
+	}
+	return words[n-1]
+}
+
+func fnWordlist(x *expander, args []string) string {
+	start := x.number(args[0], "wordlist", "first")
+	end := x.number(args[1], "wordlist", "second")
+	if start < 1 {
+		x.fail("invalid first argument to 'wordlist' function: '%d'", start)
+	}
+	words := strings.Fields(args[2])
+	if end > len(words) {
+		end = len(words)
+	}
+	if start > end {
+		return ""
+	}
+	return strings.Join(words[start-1:end], " ")
+}
+
+func fnWords(x *expander, args []string) string {
+	return strconv.Itoa(len(strings.Fields(args[0])))
+}
+
+func fnFirstword(x *expander, args []string) string {
+	words := strings.Fields(args[0])
+	if len(words) == 0 {
+		return ""
+	}
+	return words[0]
+}
+
+func fnLastword(x *expander, args []string) string {
+	words := strings.Fields(args[0])
+	if len(words) == 0 {
+		return ""
+	}
+	return words[len(words)-1]
+}
+
+func fnDir(x *expander, args []string) string {
+	return mapWords(args[0], func(word string) string {
+		if pos := strings.LastIndex(word, "/"); pos != -1 {
+			return word[:pos+1]
+		}
+		return "./"
+	})
+}
+
+func fnNotdir(x *expander, args []string) string {
+	return mapWords(args[0], func(word string) string {
+		return word[strings.LastIndex(word, "/")+1:]
+	})
+}
+
+// suffixIndex returns the index of the "." that starts the suffix of the given word,
+// or -1 if there is no suffix
+func suffixIndex(word string) int {
+	dot := strings.LastIndex(word, ".")
+	if dot == -1 || strings.LastIndex(word, "/") > dot {
+		return -1
+	}
+	return dot
+}
+
+func fnSuffix(x *expander, args []string) string {
+	return mapWords(args[0], func(word string) string {
+		if dot := suffixIndex(word); dot != -1 {
+			return word[dot:]
+		}
+		return ""
+	})
+}
+
+func fnBasename(x *expander, args []string) string {
+	return mapWords(args[0], func(word string) string {
+		if dot := suffixIndex(word); dot != -1 {
+			return word[:dot]
+		}
+		return word
+	})
+}
+
+func fnAddsuffix(x *expander, args []string) string {
+	return mapWords(args[1], func(word string) string {
+		return word + args[0]
+	})
+}
+
+func fnAddprefix(x *expander, args []string) string {
+	return mapWords(args[1], func(word string) string {
+		return args[0] + word
+	})
+}
+
+func fnJoin(x *expander, args []string) string {
+	a, b := strings.Fields(args[0]), strings.Fields(args[1])
+	var result []string
+	for i := 0; i < len(a) || i < len(b); i++ {
+		word := ""
+		if i < len(a) {
+			word = a[i]
+		}
+		if i < len(b) {
+			word += b[i]
+		}
+		result = append(result, word)
+	}
+	return strings.Join(result, " ")
+}
+
+func fnWildcard(x *expander, args []string) string {
+	var result []string
+	for _, pattern := range strings.Fields(args[0]) {
+		result = append(result, x.db.glob(pattern)...)
+	}
+	return strings.Join(result, " ")
+}
+
+func fnRealpath(x *expander, args []string) string {
+	return mapWords(args[0], func(word string) string {
+		path, err := filepath.Abs(word)
+		if err != nil {
+			return ""
+		}
+		path, err = filepath.EvalSymlinks(path)
+		if err != nil {
+			return ""
+		}
+		return path
+	})
+}
+
+func fnAbspath(x *expander, args []string) string {
+	return mapWords(args[0], func(word string) string {
+		path, err := filepath.Abs(word)
+		if err != nil {
+			return ""
+		}
+		return path
+	})
+}
+
+func fnError(x *expander, args []string) string {
+	x.fail("%s", args[0])
+	return ""
+}
+
+func fnWarning(x *expander, args []string) string {
+	x.db.message(x.pos, "%s", args[0])
+	return ""
+}
+
+func fnInfo(x *expander, args []string) string {
+	fmt.Fprintln(x.db.stdout(), args[0])
+	return ""
+}
+
+func fnShell(x *expander, args []string) string {
+	output, status := x.db.shell(x, args[0])
+	x.db.Globals.Set(&Variable{Name: ".SHELLSTATUS", Value: strconv.Itoa(status), Flavor: Simple, Origin: OriginOverride})
+	return output
+}
+
+func fnOrigin(x *expander, args []string) string {
+	v := x.db.lookup(x.scope, args[0])
+	if v == nil {
+		return OriginUndefined.String()
+	}
+	return v.Origin.String()
+}
+
+func fnFlavor(x *expander, args []string) string {
+	v := x.db.lookup(x.scope, args[0])
+	if v == nil {
+		return Undefined.String()
+	}
+	return v.Flavor.String()
+}
+
+func fnValue(x *expander, args []string) string {
+	v := x.db.lookup(x.scope, args[0])
+	if v == nil {
+		return ""
+	}
+	return v.Value
+}
+
+func fnEval(x *expander, args []string) string {
+	file := parse.ParseString(x.pos.File, args[0])
+	e := &evaluator{db: x.db, file: file, line: x.pos.Line, origin: OriginFile}
+	e.evaluate(file.Nodes)
+	e.endRule()
+	for _, d := range file.Diagnostics {
+		if d.Message == "missing 'endif'" {
+			e.fail(d.Line, "%s", d.Message)
+		}
+	}
+	return ""
+}
+
+func fnFile(x *expander, args []string) string {
+	op := strings.TrimSpace(args[0])
+	switch {
+	case strings.HasPrefix(op, ">"):
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if strings.HasPrefix(op, ">>") {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+			op = op[2:]
+		} else {
+			op = op[1:]
+		}
+		filename := strings.TrimSpace(op)
+		f, err := os.OpenFile(filename, flags, 0666)
+		if err != nil {
+			x.fail("open: %s: %s", filename, strings.TrimPrefix(err.Error(), "open "+filename+": "))
+		}
+		defer f.Close()
+		if len(args) > 1 {
+			text := args[1]
+			if !strings.HasSuffix(text, "\n") {
+				text += "\n"
+			}
+			f.WriteString(text)
+		}
+	case strings.HasPrefix(op, "<"):
+		filename := strings.TrimSpace(op[1:])
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSuffix(string(data), "\n")
+	default:
+		x.fail("file: invalid file operation: %s", op)
+	}
+	return ""
+}
+
+func fnCall(x *expander, args []string) string {
+	name := strings.TrimSpace(args[0])
+	v := x.db.lookup(x.scope, name)
+	if v == nil {
+		if f, found := functions[name]; found {
+			// A built-in function can also be called
+			return x.call(name, f, strings.Join(args[1:], ","))
+		}
+		x.undefined(name)
+		return ""
+	}
+	// $(0) is the name, and $(1), $(2) and so on are the arguments
+	scope := NewScope(x.scope)
+	scope.Set(&Variable{Name: "0", Value: name, Flavor: Simple, Origin: OriginAutomatic})
+	for i, arg := range args[1:] {
+		scope.Set(&Variable{Name: strconv.Itoa(i + 1), Value: arg, Flavor: Simple, Origin: OriginAutomatic})
+	}
+	// Arguments from an enclosing call are hidden
+	for i := len(args); x.db.lookup(x.scope, strconv.Itoa(i)) != nil; i++ {
+		scope.Set(&Variable{Name: strconv.Itoa(i), Flavor: Simple, Origin: OriginAutomatic})
+	}
+	inner := &expander{db: x.db, scope: scope, pos: x.pos, expanding: x.expanding}
+	if v.Flavor != Recursive {
+		return v.Value
+	}
+	if x.expanding[name] {
+		x.fail("Recursive variable '%s' references itself (eventually)", name)
+	}
+	x.expanding[name] = true
+	defer delete(x.expanding, name)
+	return inner.expand(v.Value)
+}
+
+func fnForeach(x *expander, args []string) string {
+	name := strings.TrimSpace(x.expand(args[0]))
+	words := strings.Fields(x.expand(args[1]))
+	scope := NewScope(x.scope)
+	inner := &expander{db: x.db, scope: scope, pos: x.pos, expanding: x.expanding}
+	results := make([]string, 0, len(words))
+	for _, word := range words {
+		scope.Set(&Variable{Name: name, Value: word, Flavor: Simple, Origin: OriginAutomatic})
+		results = append(results, inner.expand(args[2]))
+	}
+	return strings.Join(results, " ")
+}
+
+func fnIf(x *expander, args []string) string {
+	if strings.TrimSpace(x.expand(args[0])) != "" {
+		return x.expand(args[1])
+	}
+	if len(args) > 2 {
+		return x.expand(args[2])
+	}
+	return ""
+}
+
+func fnOr(x *expander, args []string) string {
+	for _, arg := range args {
+		if value := x.expand(arg); strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func fnAnd(x *expander, args []string) string {
+	value := ""
+	for _, arg := range args {
+		if value = x.expand(arg); strings.TrimSpace(value) == "" {
+			return ""
+		}
+	}
+	return value
+}
+
+// shell runs the given command with $(SHELL) and returns the output, with newlines
+// replaced by spaces and trailing newlines removed, as $(shell ...) does.
+// Also returns the exit status.
+func (db *Database) shell(x *expander, command string) (string, int) {
+	shell := x.variable("SHELL")
+	flags := strings.Fields(x.variable(".SHELLFLAGS"))
+	cmd := exec.Command(shell, append(flags, command)...)
+	cmd.Env = db.environment(x)
+	cmd.Stderr = db.stderr()
+	cmd.Stdin = os.Stdin
+	output, err := cmd.Output()
+	status := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status = exitErr.ExitCode()
+	} else if err != nil {
+		status = 127
+	}
+	output = bytes.TrimRight(output, "\n")
+	return strings.Replace(string(output), "\n", " ", -1), status
+}
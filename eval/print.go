@@ -0,0 +1,303 @@
+package eval
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xyproto/ake/graph"
+)
+
+// Print writes the database in the format of "make -p": the variables, the pattern-specific
+// variables, the implicit rules and the files, with their prerequisites and recipes.
+// If goals have been made, the status of each target that was considered is included.
+func (db *Database) Print(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	p := &printer{db: db, w: bw}
+	p.header()
+	p.variables()
+	p.patternVariables()
+	p.directories()
+	p.implicitRules()
+	p.files()
+	p.vpath()
+	p.printf("\n# Finished Make data base on %s\n\n", timestamp(time.Now()))
+	return bw.Flush()
+}
+
+// printer writes the sections of the database
+type printer struct {
+	db *Database
+	w  *bufio.Writer
+}
+
+// printf writes formatted text
+func (p *printer) printf(format string, args ...interface{}) {
+	fmt.Fprintf(p.w, format, args...)
+}
+
+// timestamp formats the given time as ctime does, like "Sun Oct 18 16:27:44 2026"
+func timestamp(t time.Time) string {
+	return t.Format("Mon Jan _2 15:04:05 2006")
+}
+
+// header writes the version and the time the database was printed
+func (p *printer) header() {
+	p.printf("# ake, compatible with GNU Make %s\n# Built for %s\n", Version, host())
+	p.printf("\n# Make data base, printed on %s\n", timestamp(time.Now()))
+}
+
+// originName returns how the given origin is described in the database
+func originName(o Origin) string {
+	switch o {
+	case OriginFile:
+		return "makefile"
+	case OriginEnvironmentOverride:
+		return "environment under -e"
+	case OriginOverride:
+		return "'override' directive"
+	}
+	return o.String()
+}
+
+// variable writes the origin of the given variable as a comment, followed by its definition,
+// where each line of the definition starts with the given prefix
+func (p *printer) variable(v *Variable, prefix string) {
+	p.printf("# %s", originName(v.Origin))
+	if v.Pos.File != "" {
+		p.printf(" (from '%s', line %d)", v.Pos.File, v.Pos.Line)
+	}
+	p.printf("\n%s", prefix)
+	if v.Flavor == Recursive && strings.Contains(v.Value, "\n") {
+		p.printf("define %s\n%s\nendef\n", v.Name, v.Value)
+		return
+	}
+	op := ":="
+	if v.Append {
+		op = "+="
+	} else if v.Flavor == Recursive {
+		op = "="
+	}
+	value := v.Value
+	if value != "" && strings.TrimSpace(value) == "" {
+		// A value of only whitespace would be lost when the definition is read back
+		value = "$(subst ,," + value + ")"
+	} else if v.Flavor == Simple {
+		value = strings.ReplaceAll(value, "$", "$$")
+	}
+	p.printf("%s %s %s\n", v.Name, op, value)
+}
+
+// variables writes the global variables, grouped by origin and sorted by name within each group
+func (p *printer) variables() {
+	p.printf("\n# Variables\n\n")
+	vars := p.db.Globals.Variables()
+	sort.SliceStable(vars, func(i, j int) bool {
+		return vars[i].Origin < vars[j].Origin
+	})
+	for _, v := range vars {
+		p.variable(v, "")
+	}
+	p.printf("\n")
+}
+
+// patternVariables writes the pattern-specific variables, in the order the patterns were defined
+func (p *printer) patternVariables() {
+	p.printf("# Pattern-specific Variable Values\n\n")
+	p.db.mut.Lock()
+	patterns := append([]*patternScope{}, p.db.patterns...)
+	p.db.mut.Unlock()
+	count := 0
+	for _, ps := range patterns {
+		for _, v := range ps.scope.Variables() {
+			p.printf("%s :\n", ps.pattern)
+			p.variable(v, "# ")
+			p.printf("\n")
+			count++
+		}
+	}
+	if count == 0 {
+		p.printf("# No pattern-specific variable values.\n\n")
+	} else {
+		p.printf("# %d pattern-specific variable values\n", count)
+	}
+}
+
+// directories writes the directory section. Directory contents are not cached,
+// so this is only the summary line.
+func (p *printer) directories() {
+	p.printf("# Directories\n\n# 0 files, no impossibilities in 0 directories.\n\n")
+}
+
+// prerequisites writes the given normal and order-only prerequisites, each preceded by a space
+func (p *printer) prerequisites(normal, orderOnly []string) {
+	for _, name := range normal {
+		p.printf(" %s", name)
+	}
+	if len(orderOnly) > 0 {
+		p.printf(" |")
+		for _, name := range orderOnly {
+			p.printf(" %s", name)
+		}
+	}
+	p.printf("\n")
+}
+
+// recipe writes the given recipe, if any, where it was defined and its commands
+func (p *printer) recipe(recipe *graph.Recipe, builtin bool) {
+	if recipe == nil {
+		return
+	}
+	if builtin || recipe.Pos.File == "" {
+		p.printf("#  recipe to execute (built-in):\n")
+	} else {
+		p.printf("#  recipe to execute (from '%s', line %d):\n", recipe.Pos.File, recipe.Pos.Line)
+	}
+	for _, c := range recipe.Commands {
+		p.printf("\t%s\n", c.Text)
+	}
+}
+
+// implicitRules writes the pattern rules, including the built-in ones
+func (p *printer) implicitRules() {
+	p.printf("# Implicit Rules\n\n")
+	rules := p.db.Graph.PatternRules
+	terminal := 0
+	for _, rule := range rules {
+		colon := ":"
+		if rule.Terminal {
+			colon = "::"
+			terminal++
+		}
+		p.printf("%s%s", strings.Join(rule.Targets, " "), colon)
+		normal, orderOnly := rule.Normal, rule.OrderOnly
+		if rule.Deferred != nil {
+			normal, orderOnly = withDeferred(normal, orderOnly, rule.Deferred)
+		}
+		p.prerequisites(normal, orderOnly)
+		p.recipe(rule.Recipe, rule.Builtin)
+		p.printf("\n")
+	}
+	if len(rules) == 0 {
+		p.printf("# No implicit rules.\n")
+	} else {
+		p.printf("# %d implicit rules, %d (%.1f%%) terminal.\n", len(rules), terminal, 100*float64(terminal)/float64(len(rules)))
+	}
+}
+
+// files writes all targets, with their target-specific variables, prerequisites,
+// what happened when goals were made and their recipes
+func (p *printer) files() {
+	p.printf("# Files\n")
+	goals := make(map[string]bool)
+	for _, goal := range p.db.options.Goals {
+		goals[goal] = true
+	}
+	for _, t := range p.db.Graph.Targets() {
+		if !t.DoubleColon {
+			p.file(t, t.Normal, t.OrderOnly, t.Deferred, t.Recipe, goals[t.Name])
+			continue
+		}
+		for _, rule := range t.Rules {
+			var deferred []*graph.Deferred
+			if rule.Deferred != nil {
+				deferred = append(deferred, rule.Deferred)
+			}
+			p.file(t, rule.Normal, rule.OrderOnly, deferred, rule.Recipe, goals[t.Name])
+		}
+	}
+	p.printf("\n")
+}
+
+// withDeferred adds the prerequisites that have not been expanded a second time yet,
+// as they are after the first expansion
+func withDeferred(normal, orderOnly []string, deferred ...*graph.Deferred) ([]string, []string) {
+	for _, d := range deferred {
+		if text := strings.TrimSpace(d.Normal); text != "" {
+			normal = append(normal[:len(normal):len(normal)], text)
+		}
+		if text := strings.TrimSpace(d.OrderOnly); text != "" {
+			orderOnly = append(orderOnly[:len(orderOnly):len(orderOnly)], text)
+		}
+	}
+	return normal, orderOnly
+}
+
+// file writes a single entry in the files section. Targets with "::" rules have one entry per rule.
+// Prerequisites that have not been expanded a second time yet are written as they are.
+func (p *printer) file(t *graph.Target, normal, orderOnly []*graph.Target, deferred []*graph.Deferred, recipe *graph.Recipe, goal bool) {
+	p.printf("\n")
+	p.db.mut.Lock()
+	scope := p.db.targets[t.Name]
+	p.db.mut.Unlock()
+	if scope != nil {
+		for _, v := range scope.Variables() {
+			p.variable(v, t.Name+": ")
+		}
+	}
+	if !t.IsTarget {
+		p.printf("# Not a target:\n")
+	}
+	colon := ":"
+	if t.DoubleColon {
+		colon = "::"
+	}
+	p.printf("%s%s", t.Name, colon)
+	p.prerequisites(withDeferred(graph.Names(normal), graph.Names(orderOnly), deferred...))
+	if t.Phony {
+		p.printf("#  Phony target (prerequisite of .PHONY).\n")
+	}
+	if goal {
+		p.printf("#  Command line target.\n")
+	}
+	s := t.Status
+	if s == nil {
+		s = &graph.Status{}
+	}
+	if s.Searched {
+		p.printf("#  Implicit rule search has been done.\n")
+	} else {
+		p.printf("#  Implicit rule search has not been done.\n")
+	}
+	if s.Ran {
+		p.printf("#  Implicit/static pattern stem: '%s'\n", s.Stem)
+	}
+	if t.Intermediate {
+		p.printf("#  File is an intermediate prerequisite.\n")
+	}
+	switch {
+	case t.Status == nil:
+		p.printf("#  Modification time never checked.\n")
+	case !s.Exists:
+		p.printf("#  File does not exist.\n")
+	default:
+		p.printf("#  Last modified %s\n", s.MTime.Format("2006-01-02 15:04:05.000000000"))
+	}
+	if t.Status == nil {
+		p.printf("#  File has not been updated.\n")
+	} else {
+		p.printf("#  File has been updated.\n")
+		if s.Question {
+			p.printf("#  Needs to be updated (-q is set).\n")
+		} else if s.Failed {
+			p.printf("#  Failed to be updated.\n")
+		} else {
+			p.printf("#  Successfully updated.\n")
+		}
+	}
+	p.recipe(recipe, false)
+}
+
+// vpath writes the search paths. Only the general search path, from $(VPATH), is shown.
+func (p *printer) vpath() {
+	p.printf("# VPATH Search Paths\n\n# No 'vpath' search paths.\n\n")
+	value, err := p.db.Value("VPATH")
+	if err != nil || strings.TrimSpace(value) == "" {
+		p.printf("# No general ('VPATH' variable) search path.\n")
+		return
+	}
+	p.printf("# General ('VPATH' variable) search path:\n# %s\n", strings.Join(strings.Fields(value), ":"))
+}
@@ -0,0 +1,32 @@
+package eval
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestPrintOrigins checks that each variable in the database is annotated with where it was set
+func TestPrintOrigins(t *testing.T) {
+	db, _ := loadString(t, Options{
+		Environment: []string{"FOO=env"},
+		Variables:   []string{"X=1"},
+	}, "CC = gcc\noverride O := o\nS := $(CC)\nall:\n\t@echo $(CC)\n")
+	var out bytes.Buffer
+	if err := db.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# default\nMAKE_VERSION := 4.3\n",
+		"# environment\nFOO = env\n",
+		"# makefile (from 'Makefile', line 1)\nCC = gcc\n",
+		"# makefile (from 'Makefile', line 3)\nS := gcc\n",
+		"# command line\nX = 1\n",
+		"# 'override' directive (from 'Makefile', line 2)\nO := o\n",
+		"#  recipe to execute (from 'Makefile', line 5):\n\t@echo $(CC)\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("the database does not have %q", want)
+		}
+	}
+}
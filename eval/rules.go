@@ -0,0 +1,70 @@
+package eval
+
+import (
+	"github.com/xyproto/ake/graph"
+)
+
+// special handles the prerequisites of special targets, like ".PHONY" and ".SUFFIXES",
+// when a rule for the given target is evaluated. Special targets that are only looked up
+// when running recipes, like ".SILENT" and ".IGNORE", are kept as regular targets.
+func (db *Database) special(t *graph.Target, prereqs []*graph.Target) {
+	switch t.Name {
+	case ".PHONY":
+		for _, p := range prereqs {
+			p.Phony = true
+		}
+	case ".PRECIOUS":
+		for _, p := range prereqs {
+			p.Precious = true
+		}
+	case ".INTERMEDIATE":
+		for _, p := range prereqs {
+			p.Intermediate = true
+		}
+	case ".SECONDARY":
+		for _, p := range prereqs {
+			p.Secondary = true
+		}
+	case ".SUFFIXES":
+		if len(prereqs) == 0 {
+			// ".SUFFIXES:" with no prerequisites removes all known suffixes
+			db.Suffixes = nil
+			t.Normal = nil
+			return
+		}
+		for _, p := range prereqs {
+			if !containsString(db.Suffixes, p.Name) {
+				db.Suffixes = append(db.Suffixes, p.Name)
+			}
+		}
+	}
+}
+
+// containsString checks if the given slice of strings contains the given string
+func containsString(xs []string, x string) bool {
+	for _, s := range xs {
+		if s == x {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSpecial checks if the given target is listed as a prerequisite of the given special target,
+// like ".SILENT" or ".IGNORE". If the special target has no prerequisites, it applies to all
+// targets, and true is returned if the special target is defined.
+func (db *Database) IsSpecial(special string, t *graph.Target) bool {
+	s := db.Graph.Lookup(special)
+	if s == nil || !s.IsTarget {
+		return false
+	}
+	if len(s.Normal) == 0 {
+		return true
+	}
+	for _, p := range s.Normal {
+		if p == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+package eval
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/xyproto/ake/graph"
+)
+
+// Flavor is how the value of a variable is expanded
+type Flavor int
+
+const (
+	// Undefined is the flavor of a variable that is not defined
+	Undefined Flavor = iota
+	// Recursive variables are expanded every time they are used, as with "="
+	Recursive
+	// Simple variables are expanded once, when they are defined, as with ":="
+	Simple
+)
+
+// String returns the flavor as $(flavor ...) returns it
+func (f Flavor) String() string {
+	switch f {
+	case Recursive:
+		return "recursive"
+	case Simple:
+		return "simple"
+	}
+	return "undefined"
+}
+
+// Origin is where a variable was defined. Variables from origins later in the list
+// can not be changed by assignments from origins earlier in the list, with the exception
+// of environment variables, which can be changed by the makefile unless -e is given.
+type Origin int
+
+const (
+	// OriginUndefined is the origin of a variable that is not defined
+	OriginUndefined Origin = iota
+	// OriginDefault is for built-in variables, like CC
+	OriginDefault
+	// OriginEnvironment is for variables imported from the environment
+	OriginEnvironment
+	// OriginFile is for variables defined in a makefile
+	OriginFile
+	// OriginEnvironmentOverride is for variables imported from the environment, when -e is given
+	OriginEnvironmentOverride
+	// OriginCommandLine is for variables given on the command line, like "make CFLAGS=-O2"
+	OriginCommandLine
+	// OriginOverride is for variables defined with the "override" directive
+	OriginOverride
+	// OriginAutomatic is for automatic variables, like $@ and $<
+	OriginAutomatic
+)
+
+// String returns the origin as $(origin ...) returns it
+func (o Origin) String() string {
+	switch o {
+	case OriginDefault:
+		return "default"
+	case OriginEnvironment:
+		return "environment"
+	case OriginEnvironmentOverride:
+		return "environment override"
+	case OriginFile:
+		return "file"
+	case OriginCommandLine:
+		return "command line"
+	case OriginOverride:
+		return "override"
+	case OriginAutomatic:
+		return "automatic"
+	}
+	return "undefined"
+}
+
+// Variable is a make variable, with its value and where it came from
+type Variable struct {
+	Name   string
+	Value  string // the value, which is expanded when used if the variable is Recursive
+	Flavor Flavor
+	Origin Origin
+	Append bool           // a target-specific "+=", which appends to the value of the enclosing scope
+	Pos    graph.Position // where the variable was defined, if it was defined in a makefile
+}
+
+// Scope is a set of variables, like the global variables or the variables
+// that are specific to a target. Variables that are not found in a scope
+// are looked up in the parent scope.
+type Scope struct {
+	mut     sync.RWMutex
+	vars    map[string]*Variable
+	exports map[string]bool // variables that are exported (true) or unexported (false) in this scope
+	parent  *Scope
+}
+
+// NewScope creates a new and empty scope, with the given parent scope, which may be nil
+func NewScope(parent *Scope) *Scope {
+	return &Scope{vars: make(map[string]*Variable), exports: make(map[string]bool), parent: parent}
+}
+
+// Parent returns the parent scope, or nil
+func (s *Scope) Parent() *Scope {
+	return s.parent
+}
+
+// Local returns the variable with the given name, if it is defined in this scope.
+// The parent scopes are not searched.
+func (s *Scope) Local(name string) *Variable {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.vars[name]
+}
+
+// Lookup returns the variable with the given name, from this scope or the closest parent scope
+// that has it. A target-specific "+=" variable is combined with the value from the parent scopes.
+// Returns nil if the variable is not defined.
+func (s *Scope) Lookup(name string) *Variable {
+	for scope := s; scope != nil; scope = scope.parent {
+		v := scope.Local(name)
+		if v == nil {
+			continue
+		}
+		if !v.Append || scope.parent == nil {
+			return v
+		}
+		base := scope.parent.Lookup(name)
+		if base == nil {
+			combined := *v
+			combined.Append = false
+			return &combined
+		}
+		combined := *base
+		if base.Value == "" {
+			combined.Value = v.Value
+		} else if v.Value != "" {
+			combined.Value = base.Value + " " + v.Value
+		}
+		if v.Origin > base.Origin {
+			combined.Origin = v.Origin
+		}
+		return &combined
+	}
+	return nil
+}
+
+// Set defines the given variable in this scope, replacing any existing variable with the same name
+func (s *Scope) Set(v *Variable) {
+	s.mut.Lock()
+	s.vars[v.Name] = v
+	s.mut.Unlock()
+}
+
+// Delete removes the variable with the given name from this scope
+func (s *Scope) Delete(name string) {
+	s.mut.Lock()
+	delete(s.vars, name)
+	s.mut.Unlock()
+}
+
+// setExport marks the variable with the given name as exported or unexported in this scope,
+// as with "all: export CFLAGS = -O2"
+func (s *Scope) setExport(name string, export bool) {
+	s.mut.Lock()
+	s.exports[name] = export
+	s.mut.Unlock()
+}
+
+// exportFlag returns if the variable with the given name is exported, from this scope or the
+// closest parent scope where it is marked as exported or unexported. The last result is false
+// if it is not marked in any of the scopes.
+func (s *Scope) exportFlag(name string) (export, found bool) {
+	for scope := s; scope != nil; scope = scope.parent {
+		scope.mut.RLock()
+		export, found = scope.exports[name]
+		scope.mut.RUnlock()
+		if found {
+			return export, true
+		}
+	}
+	return false, false
+}
+
+// allNames returns the sorted names of all variables that are defined in this scope
+// or in any of the parent scopes
+func (s *Scope) allNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for scope := s; scope != nil; scope = scope.parent {
+		for _, name := range scope.Names() {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Names returns the sorted names of all variables that are defined in this scope
+func (s *Scope) Names() []string {
+	s.mut.RLock()
+	names := make([]string, 0, len(s.vars))
+	for name := range s.vars {
+		names = append(names, name)
+	}
+	s.mut.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Variables returns all variables that are defined in this scope, sorted by name
+func (s *Scope) Variables() []*Variable {
+	names := s.Names()
+	vars := make([]*Variable, len(names))
+	s.mut.RLock()
+	for i, name := range names {
+		vars[i] = s.vars[name]
+	}
+	s.mut.RUnlock()
+	return vars
+}
@@ -0,0 +1,105 @@
+package eval
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestCommandLineVariables checks that variables from the command line win over the makefile,
+// except for "override", which works with all the assignment operators
+func TestCommandLineVariables(t *testing.T) {
+	db, _ := loadString(t, Options{
+		Variables: []string{"CFLAGS=-O0", "LDFLAGS=-s", "X=cl", "Y=cl", "Z=cl", "LIST:=a b"},
+	}, "CFLAGS = -O2\noverride LDFLAGS += -g\nX := file\noverride Y := file\nZ ?= file\nLIST += c\n"+
+		"override NEW ?= new\n")
+	for _, test := range []struct {
+		name, value string
+		origin      Origin
+	}{
+		{"CFLAGS", "-O0", OriginCommandLine},
+		{"LDFLAGS", "-s -g", OriginOverride},
+		{"X", "cl", OriginCommandLine},
+		{"Y", "file", OriginOverride},
+		{"Z", "cl", OriginCommandLine},
+		{"LIST", "a b", OriginCommandLine},
+		{"NEW", "new", OriginOverride},
+	} {
+		v := db.Lookup(test.name)
+		if v == nil {
+			t.Errorf("$(%s) is not defined", test.name)
+			continue
+		}
+		if value, err := db.Value(test.name); err != nil || value != test.value || v.Origin != test.origin {
+			t.Errorf("$(%s) is %q from %s, want %q from %s", test.name, value, originName(v.Origin), test.value, originName(test.origin))
+		}
+	}
+}
+
+// TestRecursiveMake checks the variables that are given to sub-makes: $(MAKE), $(MFLAGS),
+// which is $(MAKEFLAGS) without the variables, and $(MAKELEVEL), which is one higher in recipes
+func TestRecursiveMake(t *testing.T) {
+	for _, test := range []struct {
+		makeFlags, mflags string
+		level             string
+	}{
+		{"", "", ""},
+		{"en", "-en", "0"},
+		{"iks -Iinc --no-print-directory -- X=1 CFLAGS=a\\ b", "-iks -Iinc --no-print-directory", "2"},
+		{" --no-print-directory", "--no-print-directory", "1"},
+		{" -- X=1", "", "0"},
+		{" -j4 --trace --eval=X=1 --eval=Y\\ =\\ 2 -- Z=3", "-j4 --trace", "0"},
+	} {
+		environment := []string{"MAKELEVEL=" + test.level}
+		db, _ := loadString(t, Options{Environment: environment, MakeFlags: test.makeFlags, Command: "/bin/ake"}, "")
+		level := test.level
+		if level == "" {
+			level = "0"
+		}
+		for _, v := range []struct{ name, want string }{
+			{"MAKE", "/bin/ake"},
+			{"MAKEFLAGS", test.makeFlags},
+			{"MFLAGS", test.mflags},
+			{"MAKELEVEL", level},
+		} {
+			if value, err := db.Value(v.name); err != nil || value != v.want {
+				t.Errorf("%q: $(%s) is %q, want %q", test.makeFlags, v.name, value, v.want)
+			}
+		}
+		env, err := db.Environment(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := strconv.Atoi(level)
+		if want := "MAKELEVEL=" + strconv.Itoa(n+1); !containsString(env, want) {
+			t.Errorf("%q: the environment %q does not have %s", test.makeFlags, env, want)
+		}
+		if want := "MAKEFLAGS=" + test.makeFlags; !containsString(env, want) {
+			t.Errorf("%q: the environment %q does not have %s", test.makeFlags, env, want)
+		}
+	}
+}
+
+// TestMakeRestarts checks that $(MAKE_RESTARTS) is taken from the environment after a restart,
+// but is not passed on to the environment of recipes
+func TestMakeRestarts(t *testing.T) {
+	for _, restarts := range []string{"", "1", "2"} {
+		var environment []string
+		if restarts != "" {
+			environment = []string{"MAKE_RESTARTS=" + restarts}
+		}
+		db, _ := loadString(t, Options{Environment: environment}, "")
+		if value, err := db.Value("MAKE_RESTARTS"); err != nil || value != restarts {
+			t.Errorf("$(MAKE_RESTARTS) is %q, want %q", value, restarts)
+		}
+		env, err := db.Environment(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range env {
+			if strings.HasPrefix(s, "MAKE_RESTARTS=") {
+				t.Errorf("the environment has %q", s)
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package exec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The magic strings at the start of ar archives, and of thin archives, which only refer to
+// the member files
+const (
+	arMagic     = "!<arch>\n"
+	arThinMagic = "!<thin>\n"
+)
+
+// The layout of the header of each archive member, which is 60 bytes of text
+const (
+	arHeaderSize = 60
+	arNameEnd    = 16
+	arDateStart  = 16
+	arDateEnd    = 28
+	arSizeStart  = 48
+	arSizeEnd    = 58
+)
+
+// errNotArchive is returned when a file is not an ar archive
+var errNotArchive = errors.New("not a valid archive")
+
+// arMember is a member of an ar archive
+type arMember struct {
+	name   string
+	date   int64 // the modification time, in seconds since 1970
+	offset int64 // where the header of the member starts in the archive
+}
+
+// readArchive reads the headers of all the members of the ar archive with the given name.
+// Both the GNU and the BSD variants of long member names are understood.
+func readArchive(name string) ([]arMember, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return nil, errNotArchive
+	}
+	thin := string(magic) == arThinMagic
+	if !thin && string(magic) != arMagic {
+		return nil, errNotArchive
+	}
+	var (
+		members   []arMember
+		longNames []byte // the table of long names, from the member named "//"
+		header    = make([]byte, arHeaderSize)
+		offset    = int64(len(arMagic))
+	)
+	for {
+		if _, err := io.ReadFull(f, header); err == io.EOF {
+			return members, nil
+		} else if err != nil || string(header[arHeaderSize-2:]) != "`\n" {
+			return nil, errNotArchive
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[arSizeStart:arSizeEnd])), 10, 64)
+		if err != nil || size < 0 {
+			return nil, errNotArchive
+		}
+		date, _ := strconv.ParseInt(strings.TrimSpace(string(header[arDateStart:arDateEnd])), 10, 64)
+		field := strings.TrimRight(string(header[:arNameEnd]), " ")
+		data := offset + arHeaderSize
+		member := arMember{date: date, offset: offset}
+		// The symbol table and the table of long names are stored in thin archives too
+		stored := !thin
+		switch {
+		case field == "/" || field == "/SYM64/" || strings.HasPrefix(field, "__.SYMDEF"):
+			// The symbol table
+			stored = true
+		case field == "//":
+			longNames = make([]byte, size)
+			if _, err := io.ReadFull(f, longNames); err != nil {
+				return nil, errNotArchive
+			}
+			stored = true
+		case strings.HasPrefix(field, "#1/"):
+			// BSD: the name follows the header, and is part of the size
+			n, err := strconv.Atoi(field[3:])
+			if err != nil || n < 0 || int64(n) > size {
+				return nil, errNotArchive
+			}
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(f, buf); err != nil {
+				return nil, errNotArchive
+			}
+			member.name = string(bytes.TrimRight(buf, "\x00"))
+			size -= int64(n)
+			data += int64(n)
+		case strings.HasPrefix(field, "/"):
+			// GNU: an offset into the table of long names, where names end with "/\n"
+			n, err := strconv.Atoi(field[1:])
+			if err != nil || n < 0 || n >= len(longNames) {
+				return nil, errNotArchive
+			}
+			long := string(longNames[n:])
+			if end := strings.Index(long, "\n"); end != -1 {
+				long = long[:end]
+			}
+			member.name = strings.TrimSuffix(long, "/")
+		default:
+			member.name = strings.TrimSuffix(field, "/")
+		}
+		if member.name != "" {
+			members = append(members, member)
+		}
+		if !stored {
+			size = 0
+		}
+		// Members start at even offsets
+		next := data + size + (data+size)%2
+		if _, err := f.Seek(next, io.SeekStart); err != nil {
+			return nil, errNotArchive
+		}
+		offset = next
+	}
+}
+
+// findMember returns the first member of the given archive with the given name.
+// Archives only store the file names of their members, so any directory is ignored.
+func findMember(members []arMember, name string) (arMember, bool) {
+	name = path.Base(name)
+	for _, m := range members {
+		if m.name == name {
+			return m, true
+		}
+	}
+	return arMember{}, false
+}
+
+// memberTime returns the modification time of a member of an ar archive, and if it exists.
+// A member with no modification time, as ar gives members in deterministic mode, is
+// considered not to exist, as GNU Make does, so that it is always updated.
+func memberTime(archive, member string) (time.Time, bool) {
+	members, err := readArchive(archive)
+	if err != nil {
+		return time.Time{}, false
+	}
+	m, found := findMember(members, member)
+	if !found || m.date <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(m.date, 0), true
+}
+
+// touchMember sets the modification time of a member of an ar archive to the current time,
+// by rewriting the date in its header, as with -t
+func touchMember(archive, member string) error {
+	if _, err := os.Stat(archive); err != nil {
+		return fmt.Errorf("touch: Archive '%s' does not exist", archive)
+	}
+	members, err := readArchive(archive)
+	if err != nil {
+		return fmt.Errorf("touch: '%s' is not a valid archive", archive)
+	}
+	m, found := findMember(members, member)
+	if !found {
+		return fmt.Errorf("touch: Member '%s' does not exist in '%s'", member, archive)
+	}
+	f, err := os.OpenFile(archive, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("touch: %s", err)
+	}
+	date := fmt.Sprintf("%-*d", arDateEnd-arDateStart, time.Now().Unix())
+	if _, err := f.WriteAt([]byte(date), m.offset+arDateStart); err != nil {
+		f.Close()
+		return fmt.Errorf("touch: %s", err)
+	}
+	return f.Close()
+}
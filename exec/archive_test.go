@@ -0,0 +1,104 @@
+package exec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeArchive writes an ar archive in the GNU format, with the given modification times of
+// the members, which have no data. Names that are too long for the header are stored in the
+// table of long names.
+func writeArchive(t *testing.T, name string, members []string, dates []int64) {
+	t.Helper()
+	var sb, long strings.Builder
+	header := func(field string, date int64, size int) {
+		fmt.Fprintf(&sb, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", field, date, 0, 0, "644", size)
+	}
+	sb.WriteString(arMagic)
+	var fields []string
+	for _, member := range members {
+		if len(member) < 16 {
+			fields = append(fields, member+"/")
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("/%d", long.Len()))
+		long.WriteString(member + "/\n")
+	}
+	if long.Len() > 0 {
+		header("//", 0, long.Len())
+		sb.WriteString(long.String())
+		if long.Len()%2 == 1 {
+			sb.WriteString("\n")
+		}
+	}
+	for i, field := range fields {
+		header(field, dates[i], 0)
+	}
+	if err := ioutil.WriteFile(name, []byte(sb.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMemberTime checks the modification times that are read from the headers of an archive
+func TestMemberTime(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "lib.a")
+	writeArchive(t, archive, []string{"a.o", "a_very_long_member_name.o", "zero.o"}, []int64{1000, 2000, 0})
+	for _, test := range []struct {
+		member string
+		date   int64
+		found  bool
+	}{
+		{"a.o", 1000, true},
+		{"dir/a.o", 1000, true},
+		{"a_very_long_member_name.o", 2000, true},
+		{"zero.o", 0, false},
+		{"missing.o", 0, false},
+	} {
+		mtime, found := memberTime(archive, test.member)
+		if found != test.found || (found && mtime.Unix() != test.date) {
+			t.Errorf("%s: got %v and %v, want %d and %v", test.member, mtime, found, test.date, test.found)
+		}
+	}
+	if err := touchMember(archive, "a.o"); err != nil {
+		t.Fatal(err)
+	}
+	if mtime, found := memberTime(archive, "a.o"); !found || time.Since(mtime) > time.Minute {
+		t.Errorf("a.o was not touched, its time is %v", mtime)
+	}
+	if _, found := memberTime(archive, "a_very_long_member_name.o"); !found {
+		t.Errorf("touching a.o broke the archive")
+	}
+}
+
+// TestArchiveMembers checks that a reference to several members of an archive makes each of
+// them, with the member in $%
+func TestArchiveMembers(t *testing.T) {
+	defer chdir(t, t.TempDir())()
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"a.o", "b.o"} {
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const makefile = "lib.a: lib.a(a.o b.o)\n\t@echo \"[$?]\"\nlib.a(%.o): %.o\n\t@echo \"$@ $% $<\"\n"
+	stdout, stderr, err := run(t, makefile, Options{DryRun: true})
+	want := "echo \"lib.a a.o a.o\"\necho \"lib.a b.o b.o\"\necho \"[a.o b.o]\"\n"
+	if err != nil || stdout != want {
+		t.Errorf("Run returned %v, stdout is %q and stderr is %q, want %q", err, stdout, stderr, want)
+	}
+	// A member that is newer than its file is not made again, and a member without a time is
+	writeArchive(t, "lib.a", []string{"a.o", "b.o"}, []int64{time.Now().Add(-time.Hour).Unix(), 0})
+	stdout, stderr, err = run(t, makefile, Options{DryRun: true})
+	want = "echo \"lib.a b.o b.o\"\necho \"[b.o]\"\n"
+	if err != nil || stdout != want {
+		t.Errorf("Run returned %v, stdout is %q and stderr is %q, want %q", err, stdout, stderr, want)
+	}
+}
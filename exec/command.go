@@ -0,0 +1,72 @@
+package exec
+
+import (
+	"strings"
+)
+
+// Command is a single recipe line, after it has been expanded, with the prefixes interpreted
+type Command struct {
+	Line        string // the command, without the "@", "-" and "+" prefixes
+	Silent      bool   // "@", the command is not echoed before it is run
+	IgnoreError bool   // "-", errors from the command are ignored
+	Always      bool   // "+", the command is run even with -n, -t or -q
+}
+
+// NewCommand interprets the "@", "-" and "+" prefixes of an expanded recipe line.
+// The prefixes may be given in any order, with whitespace between them.
+func NewCommand(line string) *Command {
+	c := &Command{}
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			break
+		}
+		switch line[0] {
+		case '@':
+			c.Silent = true
+		case '-':
+			c.IgnoreError = true
+		case '+':
+			c.Always = true
+		default:
+			c.Line = line
+			return c
+		}
+		line = line[1:]
+	}
+	return c
+}
+
+// splitCommands splits an expanded recipe line into one command per line, since a variable
+// that is defined with "define" can expand to several lines. Lines that end with "\" are
+// kept together, since the shell is given the backslash and newline as they are.
+func splitCommands(expanded string) []string {
+	var (
+		commands []string
+		current  string
+	)
+	for _, line := range strings.Split(expanded, "\n") {
+		if current != "" {
+			current += "\n"
+		}
+		current += line
+		if continues(line) {
+			continue
+		}
+		commands = append(commands, current)
+		current = ""
+	}
+	if current != "" {
+		commands = append(commands, current)
+	}
+	return commands
+}
+
+// continues checks if the given line ends with an odd number of "\"
+func continues(line string) bool {
+	count := 0
+	for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+		count++
+	}
+	return count%2 == 1
+}
@@ -0,0 +1,133 @@
+package exec
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xyproto/ake/eval"
+	"github.com/xyproto/ake/graph"
+)
+
+// Debug is what debugging information is printed while goals are made, as with -d and --debug
+type Debug struct {
+	Basic     bool // which targets are out of date, and if they were remade, as with --debug=b
+	Verbose   bool // also which targets are considered, and why they are up to date, as with --debug=v
+	Implicit  bool // the search for implicit rules, as with --debug=i
+	Jobs      bool // the child processes that are started and reaped, as with --debug=j
+	Makefiles bool // the basic information while the makefiles are remade, as with --debug=m
+	Recipes   bool // the commands that are run, even if they are silent, as with --debug=p
+}
+
+// ParseDebug parses the value of --debug, which is a list of words separated by commas or
+// spaces, where only the first letter of each word matters, like "b,v" or "basic verbose".
+// An empty value means "basic". Verbose and implicit information include the basic information.
+func ParseDebug(value string) (Debug, error) {
+	var d Debug
+	if strings.TrimSpace(value) == "" {
+		d.Basic = true
+		return d, nil
+	}
+	rest := value
+	for rest != "" {
+		rest = strings.TrimLeft(rest, ", ")
+		if rest == "" {
+			break
+		}
+		switch rest[0] {
+		case 'a':
+			d = Debug{Basic: true, Verbose: true, Implicit: true, Jobs: true, Makefiles: true, Recipes: true}
+		case 'b':
+			d.Basic = true
+		case 'v':
+			d.Basic, d.Verbose = true, true
+		case 'i':
+			d.Basic, d.Implicit = true, true
+		case 'j':
+			d.Jobs = true
+		case 'm':
+			d.Basic, d.Makefiles = true, true
+		case 'p', 'r':
+			d.Recipes = true
+		case 'n':
+			d = Debug{}
+		default:
+			return d, fmt.Errorf("unknown debug level specification '%s'", rest)
+		}
+		if end := strings.IndexAny(rest, ", "); end != -1 {
+			rest = rest[end:]
+		} else {
+			rest = ""
+		}
+	}
+	return d, nil
+}
+
+// debugf writes a debugging message to Stdout if enabled is true, indented by the given depth,
+// which is how far down the target is from the goal, as GNU Make does
+func (e *Executor) debugf(enabled bool, depth int, format string, args ...interface{}) {
+	if !enabled {
+		return
+	}
+	fmt.Fprintf(e.options.Stdout, "%s%s\n", strings.Repeat(" ", depth), fmt.Sprintf(format, args...))
+}
+
+// findRule searches for an implicit rule for the target with the given name, where the
+// given scope is the parent of the scope of the target. With --debug=i, each step of the
+// search is printed, indented by the given depth.
+func (e *Executor) findRule(name string, parent *eval.Scope, depth int) (*graph.Match, error) {
+	var err error
+	s := e.search(parent, &err)
+	if e.options.Debug.Implicit {
+		s.Log = func(d int, format string, args ...interface{}) {
+			e.debugf(true, depth+2*d, format, args...)
+		}
+	}
+	match := e.db.Graph.FindRuleWith(name, s)
+	return match, err
+}
+
+// explain writes how each prerequisite of an existing target compares to it, which
+// is the reason the target is remade or not
+func (e *Executor) explain(name string, normal, orderOnly []*graph.Target, nodes []*node, mtime time.Time, depth int) {
+	debug := e.options.Debug
+	for i, p := range normal {
+		n := nodes[i]
+		switch {
+		case n == nil:
+		case n.remade || n.mtime.After(mtime):
+			e.debugf(debug.Basic, depth, "Prerequisite '%s' is newer than target '%s'.", p.Name, name)
+		default:
+			e.debugf(debug.Verbose, depth, "Prerequisite '%s' is older than target '%s'.", p.Name, name)
+		}
+	}
+	for _, p := range orderOnly {
+		e.debugf(debug.Verbose, depth, "Prerequisite '%s' is order-only for target '%s'.", p.Name, name)
+	}
+}
+
+// remade writes if the recipe of a target succeeded or failed
+func (e *Executor) remade(name string, err error, depth int) {
+	switch err {
+	case nil:
+		e.debugf(e.options.Debug.Basic, depth, "Successfully remade target file '%s'.", name)
+	case ErrOutOfDate:
+	default:
+		e.debugf(e.options.Debug.Basic, depth, "Failed to remake target file '%s'.", name)
+	}
+}
+
+// trace writes why the recipe of a target is run, with where the recipe is, as with --trace:
+// either because the target does not exist, or because of the prerequisites that are newer
+func (e *Executor) trace(t *graph.Target, recipe *graph.Recipe, scope *eval.Scope) {
+	location := "<builtin>"
+	if recipe.Pos.File != "" {
+		location = fmt.Sprintf("%s:%d", recipe.Pos.File, recipe.Pos.Line)
+	}
+	newer, err := e.db.Expand("$?", scope, recipe.Pos)
+	if err != nil || newer == "" {
+		fmt.Fprintf(e.options.Stdout, "%s: target '%s' does not exist\n", location, t.Name)
+		return
+	}
+	fmt.Fprintf(e.options.Stdout, "%s: update target '%s' due to: %s\n", location, t.Name, newer)
+}
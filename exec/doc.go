@@ -0,0 +1,9 @@
+// Package exec makes goals, by running the recipes of the targets in an evaluated
+// makefile that are out of date, after their prerequisites have been made.
+//
+// Callbacks can be given in the Options, to follow the progress:
+//
+//	err := exec.Run(db, exec.Options{
+//		OnStart: func(t *graph.Target) { log.Println("making", t.Name) },
+//	}, "all")
+package exec
@@ -0,0 +1,1074 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyproto/ake/eval"
+	"github.com/xyproto/ake/graph"
+)
+
+// Options is how goals should be made
+type Options struct {
+	Jobs         int        // how many recipes may run at the same time, 1 if not set
+	Silent       bool       // do not echo commands, as with -s
+	DryRun       bool       // print commands instead of running them, as with -n, except recursive ones
+	Question     bool       // run nothing, but return ErrOutOfDate if a goal is out of date, as with -q
+	Touch        bool       // touch out of date targets instead of running their recipes, as with -t
+	Always       bool       // consider all targets out of date, as with -B
+	Symlinks     bool       // use the newest modification time of symbolic links and their targets, as with -L
+	KeepGoing    bool       // continue with targets that do not depend on a target that failed, as with -k
+	IgnoreErrors bool       // ignore errors from all commands, as if they had the "-" prefix, as with -i
+	OldFiles     []string   // files that are considered very old, and are never remade, as with -o
+	Jobserver    *Jobserver // job slots that are shared with sub-makes and parent makes, if set
+	NewFiles     []string   // files that are considered infinitely new, as with -W
+	Trace        bool       // print why each recipe is run, and echo all commands, as with --trace
+	Debug        Debug      // what debugging information to print, as with -d and --debug
+	Stdout       io.Writer  // where commands are echoed, and where their output goes, os.Stdout if nil
+	Stderr       io.Writer  // where errors are written, and where commands write their errors, os.Stderr if nil
+
+	// Interrupt is where signals like SIGINT and SIGTERM are received, if set. When a signal is
+	// received, the running commands are killed, the targets they were making are deleted and
+	// no more commands are started. Run then returns an *InterruptedError, once the killed
+	// commands have finished, without waiting for other targets or for job slots.
+	Interrupt <-chan os.Signal
+
+	// OnStart is called before the recipe of a target is run, if set
+	OnStart func(t *graph.Target)
+	// OnCommand is called before a command is run, after it has been expanded, if set
+	OnCommand func(t *graph.Target, c *Command)
+	// OnFinish is called after the recipe of a target has been run, with any error, if set
+	OnFinish func(t *graph.Target, err error)
+}
+
+// oldTime and newTime are the modification times of files given with -o and -W
+var (
+	oldTime = time.Unix(1, 0)
+	newTime = time.Unix(1<<40, 0)
+)
+
+// maxChainLength is how deep intermediate files are followed, the same as for graph.FindRule
+const maxChainLength = 8
+
+// ErrFailed is returned by Run when a goal could not be made.
+// What went wrong has then already been written to Stderr.
+var ErrFailed = errors.New("could not make all goals")
+
+// ErrOutOfDate is returned by Run when Question is set and a goal is out of date
+var ErrOutOfDate = errors.New("a goal is out of date")
+
+// InterruptedError is returned by Run when a signal is received from Options.Interrupt
+type InterruptedError struct {
+	Signal os.Signal
+}
+
+// Error returns the description of the signal
+func (err *InterruptedError) Error() string {
+	return "interrupted by signal: " + err.Signal.String()
+}
+
+// errInterrupted is the error of a target that was not made, because a signal was received
+// while waiting for it
+var errInterrupted = errors.New("interrupted")
+
+// errNoRule is the error of a makefile that is remade, when there is no rule to make it
+var errNoRule = errors.New("no rule to make target")
+
+// Executor makes goals, by running the recipes of targets that are out of date
+type Executor struct {
+	db            *eval.Database
+	options       Options
+	mut           sync.Mutex
+	nodes         map[string]*node     // the targets that are being made, or have been made
+	jobs          chan struct{}        // one element per running recipe
+	started       int                  // how many recipes have been started
+	intermediates []string             // intermediate files that have been made, and should be removed
+	old           map[string]bool      // files given with -o
+	new           map[string]bool      // files given with -W
+	remaking      bool                 // the goals are makefiles, which do not need a rule, see Remake
+	optional      map[string]bool      // makefiles whose errors are not reported, see Remake
+	running       map[*osexec.Cmd]*job // the commands that are running, to kill them after a signal
+	interrupted   os.Signal            // the signal that was received, if any
+	stopped       chan struct{}        // closed when a signal has been received, to stop all waiting
+	recipes       sync.WaitGroup       // the recipes that are running, which are waited for after a signal
+	signalMut     sync.Mutex           // held while the running commands are killed, after a signal
+}
+
+// job is the recipe of a target that is running
+type job struct {
+	target  *graph.Target
+	existed bool      // the target existed before the recipe was started
+	mtime   time.Time // the modification time of the target before the recipe was started
+}
+
+// node is the state of a target that is being made, or has been made
+type node struct {
+	done      chan struct{} // closed when the target has been made
+	mtime     time.Time     // the modification time of the file, after it has been made
+	remade    bool          // a recipe was run, or there is no file, so targets that depend on it must be remade
+	hasRecipe bool          // the target has a recipe, from a rule or from an implicit rule
+	status    graph.Status  // what happened, for printing the database
+	err       error
+
+	// waits counts the nodes that the goroutines making this node are waiting for, which are
+	// the nodes of its prerequisites, to find circular dependencies between targets that are
+	// made concurrently. It is guarded by Executor.mut.
+	waits map[*node]int
+}
+
+// New creates an Executor for the targets in the given database
+func New(db *eval.Database, options Options) *Executor {
+	if options.Jobs < 1 {
+		options.Jobs = 1
+	}
+	if options.Stdout == nil {
+		options.Stdout = os.Stdout
+	}
+	if options.Stderr == nil {
+		options.Stderr = os.Stderr
+	}
+	options.Stdout = synchronized(options.Stdout)
+	options.Stderr = synchronized(options.Stderr)
+	return &Executor{
+		db:      db,
+		options: options,
+		nodes:   make(map[string]*node),
+		running: make(map[*osexec.Cmd]*job),
+		stopped: make(chan struct{}),
+		jobs:    make(chan struct{}, options.Jobs),
+		old:     names(options.OldFiles),
+		new:     names(options.NewFiles),
+	}
+}
+
+// Run makes the given goals, in order. If no goals are given, the default goal is made.
+// Returns ErrFailed if a goal could not be made, after writing the reason to Stderr.
+func Run(db *eval.Database, options Options, goals ...string) error {
+	return New(db, options).Run(goals...)
+}
+
+// Run makes the given goals, in order. If no goals are given, the default goal is made.
+// Intermediate files that were made are removed afterwards.
+// Returns ErrFailed if a goal could not be made, after writing the reason to Stderr.
+func (e *Executor) Run(goals ...string) error {
+	if len(goals) == 0 {
+		goal, err := e.db.DefaultGoal()
+		if err != nil {
+			fmt.Fprintln(e.options.Stderr, err)
+			return ErrFailed
+		}
+		if goal == "" {
+			fmt.Fprintf(e.options.Stderr, "%s: *** No targets.  Stop.\n", e.db.Program())
+			return ErrFailed
+		}
+		goals = []string{goal}
+	}
+	if err := e.expandAll(); err != nil {
+		return err
+	}
+	defer e.watchSignals()()
+	defer e.removeIntermediates()
+	failed := false
+	for _, goal := range goals {
+		if sig := e.signal(); sig != nil {
+			return e.interruptedError(sig)
+		}
+		e.mut.Lock()
+		started := e.started
+		e.mut.Unlock()
+		n := e.build(goal, nil, nil)
+		if sig := e.signal(); sig != nil {
+			return e.interruptedError(sig)
+		}
+		if n.err == ErrOutOfDate {
+			return ErrOutOfDate
+		}
+		if n.err != nil {
+			if !e.options.KeepGoing {
+				return ErrFailed
+			}
+			failed = true
+			continue
+		}
+		e.mut.Lock()
+		nothingDone := e.started == started
+		e.mut.Unlock()
+		if nothingDone && !e.options.Question {
+			if t := e.db.Graph.Lookup(goal); n.hasRecipe && (t == nil || !t.Phony) {
+				fmt.Fprintf(e.options.Stdout, "%s: '%s' is up to date.\n", e.db.Program(), goal)
+			} else {
+				fmt.Fprintf(e.options.Stdout, "%s: Nothing to be done for '%s'.\n", e.db.Program(), goal)
+			}
+		}
+	}
+	if failed {
+		return ErrFailed
+	}
+	return nil
+}
+
+// lockedWriter is an io.Writer that can be written to from several goroutines
+type lockedWriter struct {
+	mut sync.Mutex
+	w   io.Writer
+}
+
+// Write writes to the underlying io.Writer, one write at the time
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mut.Lock()
+	defer lw.mut.Unlock()
+	return lw.w.Write(p)
+}
+
+// synchronized returns an io.Writer that can be used by concurrent commands.
+// Files are returned as they are, so that commands can write directly to them.
+func synchronized(w io.Writer) io.Writer {
+	if _, ok := w.(*os.File); ok {
+		return w
+	}
+	return &lockedWriter{w: w}
+}
+
+// names returns a set of the given names
+func names(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, name := range list {
+		set[name] = true
+	}
+	return set
+}
+
+// stat returns the modification time of the given file, and if it exists.
+// Files given with -o are very old, and files given with -W are infinitely new.
+// For an archive member, like "lib.a(main.o)", the time is read from the archive.
+func (e *Executor) stat(name string) (time.Time, bool) {
+	if e.old[name] {
+		return oldTime, true
+	}
+	if e.new[name] {
+		return newTime, true
+	}
+	if archive, member, ok := graph.SplitMember(name); ok {
+		return memberTime(archive, member)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if e.options.Symlinks {
+		return newestLink(name, fi.ModTime()), true
+	}
+	return fi.ModTime(), true
+}
+
+// maxSymlinks is how many symbolic links are followed, the same limit as Linux has
+const maxSymlinks = 40
+
+// newestLink follows the chain of symbolic links from the given name, and returns
+// the newest modification time of the links and the given time of the final file
+func newestLink(name string, mtime time.Time) time.Time {
+	for i := 0; i < maxSymlinks; i++ {
+		fi, err := os.Lstat(name)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			break
+		}
+		if fi.ModTime().After(mtime) {
+			mtime = fi.ModTime()
+		}
+		dest, err := os.Readlink(name)
+		if err != nil {
+			break
+		}
+		if !filepath.IsAbs(dest) {
+			dest = filepath.Join(filepath.Dir(name), dest)
+		}
+		name = dest
+	}
+	return mtime
+}
+
+// exists checks if the given file exists
+func (e *Executor) exists(name string) bool {
+	_, found := e.stat(name)
+	return found
+}
+
+// target returns the target with the given name, adding it to the graph if needed,
+// which is the case for prerequisites that are found by implicit rules
+func (e *Executor) target(name string) *graph.Target {
+	return e.db.Graph.AddTarget(name)
+}
+
+// defined checks if the given special target, like ".NOTPARALLEL", is the target of a rule
+func (e *Executor) defined(special string) bool {
+	t := e.db.Graph.Lookup(special)
+	return t != nil && t.IsTarget
+}
+
+// build makes the target with the given name, unless it is already being made or has
+// been made, and returns its node when it is done. The scope is the scope of the target
+// that needs this one, since target-specific variables are inherited by prerequisites.
+// The chain is the targets that led to this one, to detect circular dependencies.
+// Returns nil if the dependency is circular, and has been dropped.
+func (e *Executor) build(name string, parent *eval.Scope, chain []string) *node {
+	for _, c := range chain {
+		if c == name {
+			e.circular(chain, name)
+			return nil
+		}
+	}
+	e.mut.Lock()
+	var waiter *node
+	if len(chain) > 0 {
+		waiter = e.nodes[chain[len(chain)-1]]
+	}
+	n, found := e.nodes[name]
+	if found {
+		// With several jobs, the target may be made by another goroutine, which could be
+		// waiting for the target at the end of the chain, from another path through the graph
+		if waiter != nil && reaches(n, waiter) {
+			e.mut.Unlock()
+			e.circular(chain, name)
+			return nil
+		}
+		addWait(waiter, n)
+		e.mut.Unlock()
+		defer e.removeWait(waiter, n)
+		select {
+		case <-n.done:
+			return n
+		case <-e.stopped:
+			return &node{err: errInterrupted}
+		}
+	}
+	n = &node{done: make(chan struct{}), waits: make(map[*node]int)}
+	e.nodes[name] = n
+	addWait(waiter, n)
+	e.mut.Unlock()
+	t := e.target(name)
+	e.update(n, t, parent, chain)
+	n.status.Question = n.err == ErrOutOfDate
+	n.status.Failed = n.err != nil && !n.status.Question
+	n.status.MTime, n.status.Exists = e.stat(name)
+	t.Status = &n.status
+	close(n.done)
+	e.removeWait(waiter, n)
+	return n
+}
+
+// circular reports that the dependency of the target at the end of the chain on the target
+// with the given name is circular, and is dropped
+func (e *Executor) circular(chain []string, name string) {
+	fmt.Fprintf(e.options.Stderr, "%s: Circular %s <- %s dependency dropped.\n", e.db.Program(), chain[len(chain)-1], name)
+}
+
+// addWait records that the waiter is waiting for the given node, if there is a waiter.
+// Executor.mut must be held.
+func addWait(waiter, n *node) {
+	if waiter != nil {
+		waiter.waits[n]++
+	}
+}
+
+// removeWait records that the waiter is no longer waiting for the given node
+func (e *Executor) removeWait(waiter, n *node) {
+	if waiter == nil {
+		return
+	}
+	e.mut.Lock()
+	if waiter.waits[n]--; waiter.waits[n] == 0 {
+		delete(waiter.waits, n)
+	}
+	e.mut.Unlock()
+}
+
+// reaches checks if the node from is waiting for the node to, directly or through the nodes
+// it is waiting for. Executor.mut must be held.
+func reaches(from, to *node) bool {
+	seen := make(map[*node]bool)
+	pending := []*node{from}
+	for len(pending) > 0 {
+		n := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if n == to {
+			return true
+		}
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		for w := range n.waits {
+			pending = append(pending, w)
+		}
+	}
+	return false
+}
+
+// buildAll makes the given prerequisites of the target at the end of the chain.
+// With more than one job, they are made concurrently. Unless KeepGoing is set,
+// the prerequisites after one that failed are not made, when they are made one by one. The returned slice has
+// one node per prerequisite, where circular dependencies are nil.
+func (e *Executor) buildAll(prereqs []*graph.Target, scope *eval.Scope, chain []string) ([]*node, error) {
+	nodes := make([]*node, len(prereqs))
+	if e.options.Jobs <= 1 || e.defined(".NOTPARALLEL") {
+		var err error
+		for i, p := range prereqs {
+			nodes[i] = e.build(p.Name, scope, chain)
+			if nodes[i] != nil && nodes[i].err != nil && err == nil {
+				err = nodes[i].err
+				if !e.options.KeepGoing {
+					break
+				}
+			}
+		}
+		return nodes, err
+	}
+	var wg sync.WaitGroup
+	for i, p := range prereqs {
+		wg.Add(1)
+		go func(i int, p *graph.Target) {
+			defer wg.Done()
+			nodes[i] = e.build(p.Name, scope, chain)
+		}(i, p)
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-e.stopped:
+		// The goroutines that are still running may store their nodes later
+		return nil, errInterrupted
+	}
+	for _, n := range nodes {
+		if n != nil && n.err != nil {
+			return nodes, n.err
+		}
+	}
+	return nodes, nil
+}
+
+// buildSome makes the prerequisites with the given indices, and stores their nodes at the same indices
+func (e *Executor) buildSome(prereqs []*graph.Target, nodes []*node, indices []int, scope *eval.Scope, chain []string) error {
+	if len(indices) == 0 {
+		return nil
+	}
+	some := make([]*graph.Target, len(indices))
+	for j, i := range indices {
+		some[j] = prereqs[i]
+	}
+	built, err := e.buildAll(some, scope, chain)
+	if built == nil {
+		return err
+	}
+	for j, i := range indices {
+		nodes[i] = built[j]
+	}
+	return err
+}
+
+// intermediateNeeded checks if an intermediate file that does not exist must be made,
+// because the prerequisites it would be made from are newer than the given modification time
+// of the target that needs it, or do not exist either
+func (e *Executor) intermediateNeeded(name string, mtime time.Time, depth int) bool {
+	var err error
+	match := e.db.Graph.FindRuleWith(name, e.search(nil, &err))
+	if match == nil || err != nil || depth > maxChainLength {
+		return true
+	}
+	for _, p := range match.Normal {
+		if pmtime, found := e.stat(p); found {
+			if pmtime.After(mtime) {
+				return true
+			}
+		} else if !match.Intermediate[p] || e.intermediateNeeded(p, mtime, depth+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// newer returns the prerequisites that are newer than the given modification time,
+// or that were remade. If the target does not exist, all prerequisites are returned.
+func newer(prereqs []*graph.Target, nodes []*node, mtime time.Time, targetExists bool) []*graph.Target {
+	var result []*graph.Target
+	for i, p := range prereqs {
+		n := nodes[i]
+		if n == nil {
+			continue
+		}
+		if !targetExists || n.remade || n.mtime.After(mtime) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// update makes the given target, if it is out of date, and stores the result in the node
+func (e *Executor) update(n *node, t *graph.Target, parent *eval.Scope, chain []string) {
+	name := t.Name
+	scope := e.db.TargetScope(name, parent)
+	chain = append(chain[:len(chain):len(chain)], name)
+	neededBy := ""
+	if len(chain) > 1 {
+		neededBy = chain[len(chain)-2]
+	}
+	// Debugging messages are indented by two spaces per prerequisite level, as GNU Make does
+	depth := 2 * (len(chain) - 1)
+	debug := e.options.Debug
+	e.debugf(debug.Verbose, depth, "Considering target file '%s'.", name)
+	if e.old[name] {
+		// Files given with -o are never remade, and neither are their prerequisites
+		n.mtime = oldTime
+		return
+	}
+	if t.DoubleColon {
+		e.updateDoubleColon(n, t, scope, chain)
+		return
+	}
+
+	mtime, found := e.stat(name)
+	if !found {
+		e.debugf(debug.Basic, depth+1, "File '%s' does not exist.", name)
+	}
+	// Archives only keep whole seconds, so prerequisites from the same second as a member are older
+	compared := mtime
+	if found && graph.IsMember(name) {
+		compared = mtime.Add(time.Second - time.Nanosecond)
+	}
+
+	// Find the recipe, from an explicit rule, an implicit rule or .DEFAULT
+	recipe := t.Recipe
+	normal, orderOnly := t.Normal, t.OrderOnly
+	stem := ""
+	var intermediate map[string]bool
+	if recipe == nil && !t.Phony {
+		n.status.Searched = true
+		match, err := e.findRule(name, parent, depth+1)
+		if err != nil {
+			fmt.Fprintln(e.options.Stderr, err)
+			n.err = ErrFailed
+			return
+		}
+		if match != nil {
+			recipe = match.Rule.Recipe
+			stem = match.Stem
+			intermediate = match.Intermediate
+			normal = append(e.targets(match.Normal), t.Normal...)
+			orderOnly = append(e.targets(match.OrderOnly), t.OrderOnly...)
+		}
+	}
+	if recipe == nil && !found && !t.IsTarget {
+		if d := e.db.Graph.Lookup(".DEFAULT"); d != nil && d.Recipe != nil {
+			recipe = d.Recipe
+		}
+	}
+	n.hasRecipe = recipe != nil
+	// With -B, existing files are remade as if they did not exist
+	current := found && !e.options.Always
+
+	// Make the prerequisites first. Intermediate files that do not exist are only made
+	// if the target is out of date, or if their own prerequisites are newer than the target.
+	prereqs := append(append([]*graph.Target{}, normal...), orderOnly...)
+	nodes := make([]*node, len(prereqs))
+	var now, deferred []int
+	for i, p := range prereqs {
+		if current && intermediate[p.Name] && !e.exists(p.Name) && !e.intermediateNeeded(p.Name, compared, 0) {
+			deferred = append(deferred, i)
+		} else {
+			now = append(now, i)
+		}
+	}
+	if err := e.buildSome(prereqs, nodes, now, scope, chain); err != nil {
+		e.notRemade(name, chain, err)
+		n.err = err
+		return
+	}
+	e.debugf(debug.Verbose, depth+1, "Finished prerequisites of target file '%s'.", name)
+
+	if recipe == nil {
+		if !found && !t.IsTarget && e.remaking && len(chain) == 1 {
+			n.err = errNoRule
+			return
+		}
+		if !found && !t.IsTarget {
+			stop := "  Stop."
+			if e.options.KeepGoing {
+				stop = ""
+			}
+			if neededBy != "" {
+				fmt.Fprintf(e.options.Stderr, "%s: *** No rule to make target '%s', needed by '%s'.%s\n", e.db.Program(), name, neededBy, stop)
+			} else {
+				fmt.Fprintf(e.options.Stderr, "%s: *** No rule to make target '%s'.%s\n", e.db.Program(), name, stop)
+			}
+			n.err = ErrFailed
+			return
+		}
+		// A target without a recipe, like "all: main" or "FORCE:", counts as remade if there is no such file
+		n.mtime = mtime
+		n.remade = !found
+		if found {
+			e.debugf(debug.Verbose, depth, "No need to remake target '%s'.", name)
+		} else {
+			e.debugf(debug.Basic, depth, "Must remake target '%s'.", name)
+			e.debugf(debug.Basic, depth, "Successfully remade target file '%s'.", name)
+		}
+		return
+	}
+
+	if current {
+		e.explain(name, normal, orderOnly, nodes, compared, depth+1)
+	}
+	outOfDate := newer(normal, nodes[:len(normal)], compared, current)
+	if current && !t.Phony && len(outOfDate) == 0 {
+		e.debugf(debug.Verbose, depth, "No need to remake target '%s'.", name)
+		n.mtime = mtime
+		return
+	}
+	e.debugf(debug.Basic, depth, "Must remake target '%s'.", name)
+	if len(deferred) > 0 {
+		// The target will be remade, so the intermediate files are needed after all
+		if err := e.buildSome(prereqs, nodes, deferred, scope, chain); err != nil {
+			e.notRemade(name, chain, err)
+			n.err = err
+			return
+		}
+		outOfDate = newer(normal, nodes[:len(normal)], compared, current)
+	}
+	for i, p := range normal {
+		if intermediate[p.Name] && nodes[i] != nil && nodes[i].remade && !p.Secondary && !p.Precious {
+			e.mut.Lock()
+			e.intermediates = append(e.intermediates, p.Name)
+			e.mut.Unlock()
+		}
+	}
+	if stem == "" {
+		stem = suffixStem(name, e.db.Suffixes)
+	}
+	n.status.Ran, n.status.Stem = true, stem
+	auto := automatic{target: name, normal: normal, orderOnly: orderOnly, newer: outOfDate, stem: stem}
+	n.err = e.runRecipe(t, recipe, auto.scope(scope))
+	e.remade(name, n.err, depth)
+	n.mtime, _ = e.stat(name)
+	n.remade = true
+}
+
+// notRemade reports that a goal was not remade because a prerequisite failed, when KeepGoing is set
+func (e *Executor) notRemade(name string, chain []string, err error) {
+	if len(chain) == 1 && e.options.KeepGoing && err == ErrFailed && !e.options.DryRun {
+		fmt.Fprintf(e.options.Stderr, "%s: Target '%s' not remade because of errors.\n", e.db.Program(), name)
+	}
+}
+
+// updateDoubleColon makes a target with "::" rules, where each rule is independent
+// and its recipe is run if any of the prerequisites of that rule are newer than the target.
+// A "::" rule without prerequisites always runs its recipe.
+func (e *Executor) updateDoubleColon(n *node, t *graph.Target, scope *eval.Scope, chain []string) {
+	for _, rule := range t.Rules {
+		nodes, err := e.buildAll(append(append([]*graph.Target{}, rule.Normal...), rule.OrderOnly...), scope, chain)
+		if err != nil {
+			e.notRemade(t.Name, chain, err)
+			n.err = err
+			return
+		}
+		if rule.Recipe == nil {
+			continue
+		}
+		n.hasRecipe = true
+		mtime, found := e.stat(t.Name)
+		current := found && !e.options.Always
+		outOfDate := newer(rule.Normal, nodes[:len(rule.Normal)], mtime, current)
+		if current && len(rule.Normal) > 0 && len(outOfDate) == 0 {
+			continue
+		}
+		depth := 2 * (len(chain) - 1)
+		e.debugf(e.options.Debug.Basic, depth, "Must remake target '%s'.", t.Name)
+		n.status.Ran, n.status.Stem = true, suffixStem(t.Name, e.db.Suffixes)
+		auto := automatic{target: t.Name, normal: rule.Normal, orderOnly: rule.OrderOnly, newer: outOfDate, stem: n.status.Stem}
+		n.err = e.runRecipe(t, rule.Recipe, auto.scope(scope))
+		e.remade(t.Name, n.err, depth)
+		if n.err != nil {
+			return
+		}
+		n.remade = true
+	}
+	n.mtime, _ = e.stat(t.Name)
+	if _, found := e.stat(t.Name); !found {
+		n.remade = true
+	}
+}
+
+// targets returns the targets with the given names, adding them to the graph if needed
+func (e *Executor) targets(names []string) []*graph.Target {
+	targets := make([]*graph.Target, len(names))
+	for i, name := range names {
+		targets[i] = e.target(name)
+	}
+	return targets
+}
+
+// suffixStem returns the target name without a known suffix, which is $* for explicit rules.
+// For an archive member, like "lib.a(main.o)", it is the member name without the suffix.
+// Returns an empty string if the name does not end with a known suffix.
+func suffixStem(name string, suffixes []string) string {
+	if _, member, ok := graph.SplitMember(name); ok {
+		name = member
+	}
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return ""
+}
+
+// automatic holds the values of the automatic variables, like $@ and $<
+type automatic struct {
+	target    string
+	normal    []*graph.Target
+	orderOnly []*graph.Target
+	newer     []*graph.Target
+	stem      string
+}
+
+// members returns the names of the given targets, where archive members, like "lib.a(main.o)",
+// are only the member names, like "main.o", as in $^ and $?
+func members(targets []*graph.Target) []string {
+	names := graph.Names(targets)
+	for i, name := range names {
+		if _, member, ok := graph.SplitMember(name); ok {
+			names[i] = member
+		}
+	}
+	return names
+}
+
+// scope returns a new scope, with the given parent, where the automatic variables are defined.
+// For an archive member, like "lib.a(main.o)", $@ is the archive and $% is the member.
+func (a *automatic) scope(parent *eval.Scope) *eval.Scope {
+	scope := eval.NewScope(parent)
+	set := func(name, value string) {
+		scope.Set(&eval.Variable{Name: name, Value: value, Flavor: eval.Simple, Origin: eval.OriginAutomatic})
+	}
+	first := ""
+	if len(a.normal) > 0 {
+		first = a.normal[0].Name
+	}
+	target, member := a.target, ""
+	if archive, m, ok := graph.SplitMember(a.target); ok {
+		target, member = archive, m
+	}
+	set("@", target)
+	set("%", member)
+	set("<", first)
+	set("^", strings.Join(unique(members(a.normal)), " "))
+	set("+", strings.Join(members(a.normal), " "))
+	set("?", strings.Join(unique(members(a.newer)), " "))
+	set("|", strings.Join(unique(members(a.orderOnly)), " "))
+	set("*", a.stem)
+	return scope
+}
+
+// unique returns the given names, without duplicates
+func unique(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// runRecipe expands all the commands in the recipe, then runs them one by one,
+// waiting for a free job slot first. With Question set, nothing is run, and with
+// Touch set, only the recursive commands are run before the target is touched.
+func (e *Executor) runRecipe(t *graph.Target, recipe *graph.Recipe, scope *eval.Scope) error {
+	if e.signal() != nil {
+		return ErrFailed
+	}
+	if e.options.Question {
+		return ErrOutOfDate
+	}
+	if e.options.Touch && !hasRecursive(recipe) {
+		return e.touch(t)
+	}
+	if e.options.Trace {
+		e.trace(t, recipe, scope)
+	}
+	select {
+	case e.jobs <- struct{}{}:
+	case <-e.stopped:
+		return errInterrupted
+	}
+	defer func() { <-e.jobs }()
+	if js := e.options.Jobserver; js != nil {
+		if err := e.acquire(js); err == errInterrupted {
+			return err
+		} else if err != nil {
+			fmt.Fprintf(e.options.Stderr, "%s: *** jobserver: %s\n", e.db.Program(), err)
+			return ErrFailed
+		}
+		defer js.Release()
+	}
+	if !e.startRecipe() {
+		return ErrFailed
+	}
+	defer e.recipes.Done()
+	e.mut.Lock()
+	e.started++
+	e.mut.Unlock()
+	if e.options.OnStart != nil {
+		e.options.OnStart(t)
+	}
+	err := e.runCommands(t, recipe, scope)
+	if err == nil && e.options.Touch {
+		err = e.touch(t)
+	}
+	if e.options.OnFinish != nil {
+		e.options.OnFinish(t, err)
+	}
+	return err
+}
+
+// runCommands runs the commands of a recipe. All commands are expanded before the first one is run.
+func (e *Executor) runCommands(t *graph.Target, recipe *graph.Recipe, scope *eval.Scope) error {
+	expanded := make([]string, len(recipe.Commands))
+	for i, c := range recipe.Commands {
+		text, err := e.db.Expand(c.Text, scope, c.Pos)
+		if err != nil {
+			fmt.Fprintln(e.options.Stderr, err)
+			return ErrFailed
+		}
+		expanded[i] = text
+	}
+	// The environment is only made when a command is run, which is not the case with -n,
+	// except for recursive commands and commands with the "+" prefix
+	var env []string
+	envMade := false
+	shell, err := e.db.Expand("$(SHELL)", scope, recipe.Pos)
+	if err != nil {
+		fmt.Fprintln(e.options.Stderr, err)
+		return ErrFailed
+	}
+	flags, err := e.db.Expand("$(.SHELLFLAGS)", scope, recipe.Pos)
+	if err != nil {
+		fmt.Fprintln(e.options.Stderr, err)
+		return ErrFailed
+	}
+	silent := e.options.Silent || e.db.IsSpecial(".SILENT", t)
+	ignore := e.options.IgnoreErrors || e.db.IsSpecial(".IGNORE", t)
+	j := &job{target: t}
+	j.mtime, j.existed = e.stat(t.Name)
+	for i, text := range expanded {
+		pos := recipe.Commands[i].Pos
+		recursive := isRecursive(recipe.Commands[i].Text)
+		var first *Command
+		for _, line := range splitCommands(text) {
+			c := NewCommand(line)
+			if first == nil {
+				first = c
+			} else {
+				// The prefixes of the first line apply to all the lines a recipe line expands to
+				c.Silent = c.Silent || first.Silent
+				c.IgnoreError = c.IgnoreError || first.IgnoreError
+				c.Always = c.Always || first.Always
+			}
+			if strings.TrimSpace(c.Line) == "" {
+				continue
+			}
+			skip := (e.options.DryRun || e.options.Touch) && !c.Always && !recursive
+			if skip && !e.options.DryRun {
+				continue
+			}
+			if e.options.DryRun || e.options.Trace || e.options.Debug.Recipes || (!c.Silent && !silent) {
+				fmt.Fprintln(e.options.Stdout, c.Line)
+			}
+			if skip {
+				continue
+			}
+			if e.signal() != nil {
+				return ErrFailed
+			}
+			if !envMade {
+				if env, err = e.db.Environment(scope); err != nil {
+					fmt.Fprintln(e.options.Stderr, err)
+					return ErrFailed
+				}
+				envMade = true
+			}
+			if e.options.OnCommand != nil {
+				e.options.OnCommand(t, c)
+			}
+			failure := e.run(j, shell, flags, c.Line, env, c.Always || recursive)
+			if failure == "" {
+				continue
+			}
+			location := fmt.Sprintf("%s:%d: %s", pos.File, pos.Line, t.Name)
+			if pos.File == "" {
+				// Built-in rules, and rules from --eval, have no makefile
+				location = "<builtin>: " + t.Name
+			}
+			if c.IgnoreError || ignore {
+				fmt.Fprintf(e.options.Stderr, "%s: [%s] %s (ignored)\n", e.db.Program(), location, failure)
+				continue
+			}
+			if !e.optional[t.Name] {
+				fmt.Fprintf(e.options.Stderr, "%s: *** [%s] %s\n", e.db.Program(), location, failure)
+			}
+			return ErrFailed
+		}
+	}
+	return nil
+}
+
+// isRecursive checks if the given recipe line, before it is expanded, uses $(MAKE) or ${MAKE}.
+// Such lines are run even with -n, so that sub-makes can print what they would do.
+func isRecursive(text string) bool {
+	return strings.Contains(text, "$(MAKE)") || strings.Contains(text, "${MAKE}")
+}
+
+// hasRecursive checks if any line of the given recipe, before it is expanded,
+// has the "+" prefix or uses $(MAKE)
+func hasRecursive(recipe *graph.Recipe) bool {
+	for _, c := range recipe.Commands {
+		if NewCommand(c.Text).Always || isRecursive(c.Text) {
+			return true
+		}
+	}
+	return false
+}
+
+// touch updates the modification time of the given target, creating the file if needed,
+// instead of running its recipe. Phony targets are not touched.
+func (e *Executor) touch(t *graph.Target) error {
+	if t.Phony {
+		return nil
+	}
+	e.mut.Lock()
+	e.started++
+	e.mut.Unlock()
+	if !e.options.Silent && !e.db.IsSpecial(".SILENT", t) {
+		fmt.Fprintf(e.options.Stdout, "touch %s\n", t.Name)
+	}
+	if archive, member, ok := graph.SplitMember(t.Name); ok {
+		if err := touchMember(archive, member); err != nil {
+			fmt.Fprintf(e.options.Stderr, "%s: %s\n", e.db.Program(), err)
+			return ErrFailed
+		}
+		return nil
+	}
+	f, err := os.OpenFile(t.Name, os.O_WRONLY|os.O_CREATE, 0666)
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		now := time.Now()
+		err = os.Chtimes(t.Name, now, now)
+	}
+	if err != nil {
+		fmt.Fprintf(e.options.Stderr, "%s: *** %s\n", e.db.Program(), err)
+		return ErrFailed
+	}
+	return nil
+}
+
+// run runs a single command of the given job with the given shell and shell flags, and returns
+// why it failed, like "Error 2" or "Terminated", or "" if it succeeded. The command is run in a
+// process group of its own, so that the group can be killed if a signal is received.
+// Recursive commands, which may run sub-makes, inherit the jobserver.
+func (e *Executor) run(j *job, shell, flags, line string, env []string, recursive bool) string {
+	t := j.target
+	cmd := osexec.Command(shell, append(strings.Fields(flags), line)...)
+	cmd.Env = env
+	if recursive && e.options.Jobserver != nil {
+		cmd.ExtraFiles = e.options.Jobserver.Files()
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = e.options.Stdout
+	cmd.Stderr = e.options.Stderr
+	setGroup(cmd)
+	err := cmd.Start()
+	if err == nil {
+		jobs := e.options.Debug.Jobs
+		pid := cmd.Process.Pid
+		e.debugf(jobs, 0, "Putting child %p (%s) PID %d on the chain.", cmd, t.Name, pid)
+		e.debugf(jobs, 0, "Live child %p (%s) PID %d ", cmd, t.Name, pid)
+		e.startCommand(cmd, j)
+		err = cmd.Wait()
+		e.finishCommand(cmd)
+		result := "winning"
+		if err != nil {
+			result = "losing"
+		}
+		e.debugf(jobs, 0, "Reaping %s child %p PID %d ", result, cmd, pid)
+		e.debugf(jobs, 0, "Removing child %p PID %d from chain.", cmd, pid)
+	}
+	if err == nil {
+		return ""
+	}
+	if exitErr, ok := err.(*osexec.ExitError); ok {
+		if failure := signaled(exitErr); failure != "" {
+			return failure
+		}
+		if exitErr.ExitCode() > 0 {
+			return fmt.Sprintf("Error %d", exitErr.ExitCode())
+		}
+	}
+	fmt.Fprintf(e.options.Stderr, "%s: %s\n", e.db.Program(), err)
+	return "Error 127"
+}
+
+// removeIntermediates removes the intermediate files that were made by implicit rules
+func (e *Executor) removeIntermediates() {
+	e.mut.Lock()
+	names := unique(e.intermediates)
+	e.intermediates = nil
+	e.mut.Unlock()
+	if len(names) == 0 {
+		return
+	}
+	if e.signal() != nil {
+		// After a signal, each file is reported as it is deleted, as GNU Make does
+		for _, name := range names {
+			if e.exists(name) && !e.options.DryRun {
+				fmt.Fprintf(e.options.Stderr, "%s: *** Deleting intermediate file '%s'\n", e.db.Program(), name)
+				os.Remove(name)
+			}
+		}
+		return
+	}
+	if !e.options.DryRun {
+		// Only the files that the recipes did make are removed, and with -n, none were made
+		var existing []string
+		for _, name := range names {
+			if e.exists(name) {
+				existing = append(existing, name)
+			}
+		}
+		names = existing
+	}
+	if len(names) == 0 {
+		return
+	}
+	if !e.options.Silent {
+		fmt.Fprintf(e.options.Stdout, "rm %s\n", strings.Join(names, " "))
+	}
+	if e.options.DryRun {
+		return
+	}
+	for _, name := range names {
+		os.Remove(name)
+	}
+}
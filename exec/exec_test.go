@@ -0,0 +1,376 @@
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xyproto/ake/eval"
+	"github.com/xyproto/ake/parse"
+)
+
+// load evaluates the given text of a makefile, with the environment of the test
+func load(t *testing.T, text string) *eval.Database {
+	t.Helper()
+	return loadWith(t, eval.Options{Environment: os.Environ()}, text)
+}
+
+// loadWith evaluates the given text of a makefile with the given options.
+// What is written while evaluating is discarded, unless the options say where to write it.
+func loadWith(t *testing.T, options eval.Options, text string) *eval.Database {
+	t.Helper()
+	var discarded bytes.Buffer
+	if options.Stdout == nil {
+		options.Stdout = &discarded
+	}
+	if options.Stderr == nil {
+		options.Stderr = &discarded
+	}
+	db := eval.New(options)
+	if err := db.Read(parse.ParseString("Makefile", text)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// run makes the given goals of the given makefile, and returns what was written
+// to stdout and stderr. Fails the test if Run does not return within 10 seconds.
+func run(t *testing.T, text string, options Options, goals ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	return runDatabase(t, load(t, text), options, goals...)
+}
+
+// runDatabase is run for a makefile that has already been evaluated
+func runDatabase(t *testing.T, db *eval.Database, options Options, goals ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	options.Stdout, options.Stderr = &out, &errOut
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(db, options, goals...)
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Run did not return, stderr is %q", errOut.String())
+	}
+	return out.String(), errOut.String(), err
+}
+
+// chdir changes to the given directory, for makefiles with relative names,
+// and returns a function that changes back
+func chdir(t *testing.T, dir string) func() {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		os.Chdir(wd)
+	}
+}
+
+// TestCircularParallel makes a circular dependency with several jobs, where the targets
+// of the cycle are started by different goroutines, which must not wait for each other
+func TestCircularParallel(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	const makefile = "all: a b c d e f x y\na b c d e f:\nx: y\ny: x\n"
+	for i := 0; i < 100; i++ {
+		_, stderr, err := run(t, makefile, Options{Jobs: 8})
+		if err != nil {
+			t.Fatalf("Run returned %v, stderr is %q", err, stderr)
+		}
+		if strings.Count(stderr, "make: Circular ") != 1 || !strings.HasSuffix(stderr, " dependency dropped.\n") {
+			t.Fatalf("stderr is %q", stderr)
+		}
+	}
+}
+
+// TestRemoveIntermediates checks that only the intermediate files that were made are removed,
+// while -n lists all of them
+func TestRemoveIntermediates(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.src", "b.src"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The recipe for b.mid does not make it
+	makefile := fmt.Sprintf("all: %[1]s/a.out %[1]s/b.out\n%%.out: %%.mid\n\t@touch $@\n"+
+		"%%.mid: %%.src\n\t@case $@ in *a.mid) touch $@;; esac\n", dir)
+	a, b := filepath.Join(dir, "a.mid"), filepath.Join(dir, "b.mid")
+	stdout, stderr, err := run(t, makefile, Options{DryRun: true})
+	if err != nil || !strings.HasSuffix(stdout, "rm "+a+" "+b+"\n") {
+		t.Fatalf("with -n, Run returned %v, stdout is %q and stderr is %q", err, stdout, stderr)
+	}
+	stdout, stderr, err = run(t, makefile, Options{})
+	if err != nil || stdout != "rm "+a+"\n" {
+		t.Fatalf("Run returned %v, stdout is %q and stderr is %q", err, stdout, stderr)
+	}
+	if _, err := os.Stat(a); !os.IsNotExist(err) {
+		t.Errorf("%s was not removed", a)
+	}
+}
+
+// TestPrintQuestion checks that the database printed after -q says which targets need to be updated
+func TestPrintQuestion(t *testing.T) {
+	db := load(t, "all: x\nx:\n\t@:\n")
+	if _, stderr, err := runDatabase(t, db, Options{Question: true}); err != ErrOutOfDate {
+		t.Fatalf("Run returned %v, stderr is %q", err, stderr)
+	}
+	var out bytes.Buffer
+	if err := db.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\nall: x\n#  Implicit rule search has been done.\n#  File does not exist.\n" +
+		"#  File has been updated.\n#  Needs to be updated (-q is set).\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("the database does not have %q", want)
+	}
+}
+
+// TestQuestionTouch checks the exit status of -q, and that -t touches the targets instead of
+// running their recipes. The cases are run in order, in the same directory.
+func TestQuestionTouch(t *testing.T) {
+	dir := t.TempDir()
+	makefile := fmt.Sprintf("%[1]s/x: %[1]s/y\n\techo recipe > $@\n%[1]s/y:\n\techo y > $@\n", dir)
+	x, y := filepath.Join(dir, "x"), filepath.Join(dir, "y")
+	for _, test := range []struct {
+		name    string
+		options Options
+		err     error
+		stdout  string
+	}{
+		{"question before", Options{Question: true}, ErrOutOfDate, ""},
+		{"touch", Options{Touch: true}, nil, "touch " + y + "\ntouch " + x + "\n"},
+		{"question after", Options{Question: true}, nil, ""},
+		{"touch up to date", Options{Touch: true}, nil, "make: '" + x + "' is up to date.\n"},
+	} {
+		stdout, stderr, err := run(t, makefile, test.options)
+		if err != test.err || stdout != test.stdout {
+			t.Fatalf("%s: Run returned %v, stdout is %q and stderr is %q", test.name, err, stdout, stderr)
+		}
+	}
+	for _, name := range []string{x, y} {
+		if data, err := ioutil.ReadFile(name); err != nil || len(data) != 0 {
+			t.Errorf("%s was not touched, or its recipe was run: %q, %v", name, data, err)
+		}
+	}
+}
+
+// TestNewOldFiles checks that -W makes what depends on the given files, which -n only prints,
+// and that -o keeps the given files from being remade, and from making what depends on them
+func TestNewOldFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, names := range [][]string{{"a.c", "b.c"}, {"a.o", "b.o"}, {"prog"}} {
+		for _, name := range names {
+			name = filepath.Join(dir, name)
+			if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			mtime := now.Add(time.Duration(i-3) * time.Minute)
+			if err := os.Chtimes(name, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	makefile := fmt.Sprintf("%[1]s/prog: %[1]s/a.o %[1]s/b.o\n\t@echo link $(@F)\n%%.o: %%.c\n\t@echo cc $(@F)\n", dir)
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	upToDate := "make: '" + path("prog") + "' is up to date.\n"
+	for _, test := range []struct {
+		name    string
+		options Options
+		stdout  string
+	}{
+		{"up to date", Options{DryRun: true}, upToDate},
+		{"one new file", Options{DryRun: true, NewFiles: []string{path("b.c")}}, "echo cc b.o\necho link prog\n"},
+		{"two new files", Options{DryRun: true, NewFiles: []string{path("a.c"), path("b.c")}},
+			"echo cc a.o\necho cc b.o\necho link prog\n"},
+		{"old file", Options{DryRun: true, NewFiles: []string{path("a.c")}, OldFiles: []string{path("a.o")}}, upToDate},
+		{"old files", Options{DryRun: true, NewFiles: []string{path("a.c"), path("b.c")},
+			OldFiles: []string{path("a.o"), path("b.o")}}, upToDate},
+	} {
+		stdout, stderr, err := run(t, makefile, test.options)
+		if err != nil || stdout != test.stdout {
+			t.Errorf("%s: Run returned %v, stdout is %q and stderr is %q", test.name, err, stdout, stderr)
+		}
+	}
+}
+
+// TestAlwaysSymlinks checks that -B makes targets that are up to date, and that -L uses the time
+// of a symlink that is newer than the file it points to
+func TestAlwaysSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"real", "out"} {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i-2) * time.Minute)
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "real"), filepath.Join(dir, "link")); err != nil {
+		t.Skip("symlinks can not be made:", err)
+	}
+	makefile := fmt.Sprintf("%[1]s/out: %[1]s/link\n\t@echo make $(@F)\n", dir)
+	for _, test := range []struct {
+		name    string
+		options Options
+		stdout  string
+	}{
+		{"up to date", Options{DryRun: true}, "make: '" + filepath.Join(dir, "out") + "' is up to date.\n"},
+		{"always", Options{DryRun: true, Always: true}, "echo make out\n"},
+		{"symlinks", Options{DryRun: true, Symlinks: true}, "echo make out\n"},
+	} {
+		stdout, stderr, err := run(t, makefile, test.options)
+		if err != nil || stdout != test.stdout {
+			t.Errorf("%s: Run returned %v, stdout is %q and stderr is %q", test.name, err, stdout, stderr)
+		}
+	}
+}
+
+// TestErrors checks what is made after a recipe fails, with -k and -i and without them
+func TestErrors(t *testing.T) {
+	const makefile = "all: x y\nx: bad\n\t@echo x\nbad:\n\t@echo bad; false\n\t@echo after\ny:\n\t@echo y\n"
+	const failed = "make: *** [Makefile:5: bad] Error 1\n"
+	for _, test := range []struct {
+		name           string
+		options        Options
+		goals          []string
+		err            error
+		stdout, stderr string
+	}{
+		{"stop", Options{}, nil, ErrFailed, "bad\n", failed},
+		{"keep going", Options{KeepGoing: true}, nil, ErrFailed, "bad\ny\n",
+			failed + "make: Target 'all' not remade because of errors.\n"},
+		{"keep going with goals", Options{KeepGoing: true}, []string{"x", "y"}, ErrFailed, "bad\ny\n",
+			failed + "make: Target 'x' not remade because of errors.\n"},
+		{"ignore errors", Options{IgnoreErrors: true}, nil, nil, "bad\nafter\nx\ny\n",
+			"make: [Makefile:5: bad] Error 1 (ignored)\n"},
+	} {
+		stdout, stderr, err := run(t, makefile, test.options, test.goals...)
+		if err != test.err || stdout != test.stdout || stderr != test.stderr {
+			t.Errorf("%s: Run returned %v, stdout is %q and stderr is %q", test.name, err, stdout, stderr)
+		}
+	}
+}
+
+// TestTrace checks the lines written with --trace and --debug=b for the recipes that are run
+func TestTrace(t *testing.T) {
+	dir := t.TempDir()
+	in, out, missing := filepath.Join(dir, "in"), filepath.Join(dir, "out"), filepath.Join(dir, "new")
+	makefile := fmt.Sprintf("all: %[1]s/out %[1]s/new\n%[1]s/out: %[1]s/in\n\t@echo out\n%[1]s/new:\n\t@echo new\n", dir)
+	basic, err := ParseDebug("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		options Options
+		stdout  string
+	}{
+		{"trace", Options{Trace: true}, "Makefile:3: update target '" + out + "' due to: " + in + "\necho out\nout\n" +
+			"Makefile:5: target '" + missing + "' does not exist\necho new\nnew\n"},
+		{"basic", Options{Debug: basic}, " File 'all' does not exist.\n" +
+			"   Prerequisite '" + in + "' is newer than target '" + out + "'.\n" +
+			"  Must remake target '" + out + "'.\nout\n  Successfully remade target file '" + out + "'.\n" +
+			"   File '" + missing + "' does not exist.\n  Must remake target '" + missing + "'.\nnew\n" +
+			"  Successfully remade target file '" + missing + "'.\n" +
+			"Must remake target 'all'.\nSuccessfully remade target file 'all'.\n"},
+	} {
+		now := time.Now()
+		for i, name := range []string{out, in} {
+			if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			mtime := now.Add(time.Duration(i-1) * time.Minute)
+			if err := os.Chtimes(name, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stdout, stderr, err := run(t, makefile, test.options)
+		if err != nil || stdout != test.stdout {
+			t.Errorf("%s: Run returned %v, stdout is %q and stderr is %q", test.name, err, stdout, stderr)
+		}
+	}
+}
+
+// TestParseDebug checks the flags of --debug
+func TestParseDebug(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  Debug
+		err   bool
+	}{
+		{"", Debug{Basic: true}, false},
+		{"b", Debug{Basic: true}, false},
+		{"v,j", Debug{Basic: true, Verbose: true, Jobs: true}, false},
+		{"implicit makefile", Debug{Basic: true, Implicit: true, Makefiles: true}, false},
+		{"r", Debug{Recipes: true}, false},
+		{"a", Debug{Basic: true, Verbose: true, Implicit: true, Jobs: true, Makefiles: true, Recipes: true}, false},
+		{"a,n", Debug{}, false},
+		{"x", Debug{}, true},
+	} {
+		got, err := ParseDebug(test.value)
+		if (err != nil) != test.err || (err == nil && got != test.want) {
+			t.Errorf("%q: got %+v and %v, want %+v", test.value, got, err, test.want)
+		}
+	}
+}
+
+// TestWarnUndefined checks that references to undefined variables in recipes are warned about,
+// with the line of the recipe
+func TestWarnUndefined(t *testing.T) {
+	const makefile = "X = $(UNDEF1)\nall:\n\t@echo $(X)\n\t@echo $(UNDEF2) $${UNSET}\n"
+	// The warnings are written by the database, not by the executor
+	var warnings bytes.Buffer
+	db := loadWith(t, eval.Options{WarnUndefined: true, Stderr: &warnings}, makefile)
+	stdout, stderr, err := runDatabase(t, db, Options{})
+	want := "Makefile:3: warning: undefined variable 'UNDEF1'\nMakefile:4: warning: undefined variable 'UNDEF2'\n"
+	if err != nil || stdout != "\n\n" || stderr != "" || warnings.String() != want {
+		t.Errorf("Run returned %v, stdout is %q, stderr is %q and the warnings are %q, want %q",
+			err, stdout, stderr, warnings.String(), want)
+	}
+}
+
+// TestSecondExpansion checks that the prerequisites of explicit, static pattern and implicit
+// rules are expanded again after .SECONDEXPANSION, with the automatic variables, and with the
+// variables as they are at the end of the makefile
+func TestSecondExpansion(t *testing.T) {
+	defer chdir(t, t.TempDir())()
+	const makefile = `.SECONDEXPANSION:
+SRCS = late
+all: out/x.o lib/y.o z.bin
+out/x.o: $$(@D)/.dirstamp $$(SRCS)
+	@echo "$@: $^"
+lib/y.o: %.o: $$*.c $$(@D)/.dirstamp
+	@echo "$@: $^"
+%.bin: $$*.src $$(addsuffix .h,$$*)
+	@echo "$@: $^"
+out/.dirstamp lib/.dirstamp changed lib/y.c z.src z.h:
+	@:
+SRCS = changed
+`
+	stdout, stderr, err := run(t, makefile, Options{})
+	want := "out/x.o: out/.dirstamp changed\nlib/y.o: lib/y.c lib/.dirstamp\nz.bin: z.src z.h\n"
+	if err != nil || stdout != want {
+		t.Errorf("Run returned %v, stdout is %q and stderr is %q, want %q", err, stdout, stderr, want)
+	}
+}
@@ -0,0 +1,87 @@
+package exec
+
+import (
+	"fmt"
+
+	"github.com/xyproto/ake/eval"
+	"github.com/xyproto/ake/graph"
+)
+
+// expandAll expands the prerequisites of all targets that were deferred by .SECONDEXPANSION,
+// which GNU Make does after the makefiles are read, before anything is made. Errors are
+// reported at the recipe of the target, if it has one, as GNU Make does.
+// Returns ErrFailed if the expansion failed, after writing the reason to Stderr.
+func (e *Executor) expandAll() error {
+	for _, t := range e.db.Graph.Targets() {
+		if err := e.expandTarget(t); err != nil {
+			fmt.Fprintln(e.options.Stderr, err)
+			return ErrFailed
+		}
+	}
+	return nil
+}
+
+// expandTarget expands the deferred prerequisites of the given target, and adds them to the
+// target, or to its "::" rules. The automatic variables are defined as far as they are known,
+// from the prerequisites the target already has.
+func (e *Executor) expandTarget(t *graph.Target) error {
+	scope := e.db.TargetScope(t.Name, nil)
+	for _, rule := range t.Rules {
+		if rule.Deferred == nil {
+			continue
+		}
+		auto := automatic{target: t.Name, normal: rule.Normal, orderOnly: rule.OrderOnly}
+		normal, orderOnly, err := e.db.ExpandDeferred(rule.Deferred, auto.scope(scope), recipePos(rule.Recipe), false)
+		if err != nil {
+			return err
+		}
+		rule.Normal = append(rule.Normal, e.targets(normal)...)
+		rule.OrderOnly = append(rule.OrderOnly, e.targets(orderOnly)...)
+		rule.Deferred = nil
+	}
+	for _, d := range t.Deferred {
+		auto := automatic{target: t.Name, normal: t.Normal, orderOnly: t.OrderOnly, stem: d.Stem}
+		normal, orderOnly, err := e.db.ExpandDeferred(d, auto.scope(scope), recipePos(t.Recipe), d.Stem != "")
+		if err != nil {
+			return err
+		}
+		if d.Recipe {
+			t.PrependNormal(e.targets(normal))
+		} else {
+			for _, p := range e.targets(normal) {
+				t.AddNormal(p)
+			}
+		}
+		for _, p := range e.targets(orderOnly) {
+			t.AddOrderOnly(p)
+		}
+	}
+	t.Deferred = nil
+	return nil
+}
+
+// recipePos returns where the given recipe was defined, or no position if there is no recipe
+func recipePos(recipe *graph.Recipe) graph.Position {
+	if recipe == nil {
+		return graph.Position{}
+	}
+	return recipe.Pos
+}
+
+// search returns how implicit rules are searched for, where deferred prerequisites of pattern
+// rules are expanded in the scope of each target, with the given parent scope. The first error
+// from expanding them is stored in the given error.
+func (e *Executor) search(parent *eval.Scope, err *error) graph.Search {
+	expand := func(d *graph.Deferred, target, stem string) ([]string, []string) {
+		auto := automatic{target: target, stem: stem}
+		if t := e.db.Graph.Lookup(target); t != nil {
+			auto.normal, auto.orderOnly = t.Normal, t.OrderOnly
+		}
+		normal, orderOnly, expandErr := e.db.ExpandDeferred(d, auto.scope(e.db.TargetScope(target, parent)), graph.Position{}, true)
+		if expandErr != nil && *err == nil {
+			*err = expandErr
+		}
+		return normal, orderOnly
+	}
+	return graph.Search{Exists: e.exists, Expand: expand}
+}
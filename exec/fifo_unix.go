@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package exec
+
+import "syscall"
+
+// mkfifo creates a named pipe, for a jobserver
+func mkfifo(path string) error {
+	return syscall.Mkfifo(path, 0600)
+}
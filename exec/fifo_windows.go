@@ -0,0 +1,8 @@
+package exec
+
+import "errors"
+
+// mkfifo is not available on Windows, where named pipes work differently
+func mkfifo(path string) error {
+	return errors.New("named pipes are not supported")
+}
@@ -0,0 +1,163 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrJobserverUnavailable is returned by OpenJobserver when the jobserver that a parent make
+// announced in $MAKEFLAGS can not be used, which is the case when the parent did not pass on
+// the file descriptors, because the command that started this make did not have the "+" prefix.
+var ErrJobserverUnavailable = errors.New("jobserver unavailable")
+
+// Jobserver shares job slots between make processes, with the GNU Make jobserver protocol.
+// Each slot beyond the first is a byte, a token, that is read from a pipe or a named pipe
+// before a job is started, and written back when the job is done. Every make process has
+// one implicit slot of its own, which is used when no other jobs are running.
+type Jobserver struct {
+	read, write *os.File
+	fifo        string // the named pipe, for the "fifo:" style, or "" for the pipe style
+	owner       bool   // this make created the jobserver, and removes the named pipe when closing
+	mut         sync.Mutex
+	implicit    bool   // the implicit slot is in use
+	tokens      []byte // the tokens that are held, which are written back when released
+}
+
+// NewJobserver creates a jobserver with the given number of job slots, for sub-makes to share.
+// If fifo is true, a named pipe is used, as GNU Make 4.4 does, instead of a pair of file
+// descriptors that are inherited by sub-makes, as GNU Make 4.3 and earlier do.
+func NewJobserver(jobs int, fifo bool) (*Jobserver, error) {
+	js := &Jobserver{owner: true}
+	if fifo {
+		js.fifo = filepath.Join(os.TempDir(), fmt.Sprintf("GMfifo%d", os.Getpid()))
+		if err := mkfifo(js.fifo); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(js.fifo, os.O_RDWR, 0)
+		if err != nil {
+			os.Remove(js.fifo)
+			return nil, err
+		}
+		js.read, js.write = f, f
+	} else {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		js.read, js.write = r, w
+	}
+	if jobs > 1 {
+		if _, err := js.write.Write([]byte(strings.Repeat("+", jobs-1))); err != nil {
+			js.Close()
+			return nil, err
+		}
+	}
+	return js, nil
+}
+
+// OpenJobserver connects to the jobserver of a parent make, as given by --jobserver-auth in
+// $MAKEFLAGS, which is either "fifo:PATH" or two file descriptors, like "3,4".
+// Returns ErrJobserverUnavailable if the file descriptors are not open pipes.
+func OpenJobserver(auth string) (*Jobserver, error) {
+	if strings.HasPrefix(auth, "fifo:") {
+		path := strings.TrimPrefix(auth, "fifo:")
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return nil, ErrJobserverUnavailable
+		}
+		return &Jobserver{read: f, write: f, fifo: path}, nil
+	}
+	fields := strings.Split(auth, ",")
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid jobserver auth: %s", auth)
+	}
+	var files [2]*os.File
+	for i, field := range fields {
+		fd, err := strconv.Atoi(field)
+		if err != nil || fd < 0 {
+			return nil, ErrJobserverUnavailable
+		}
+		f := os.NewFile(uintptr(fd), "jobserver")
+		if fi, err := f.Stat(); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+			return nil, ErrJobserverUnavailable
+		}
+		files[i] = f
+	}
+	return &Jobserver{read: files[0], write: files[1]}, nil
+}
+
+// Auth returns the value of --jobserver-auth for sub-makes. For the pipe style, the file
+// descriptors are 3 and 4, since they are the first files in ExtraFiles.
+func (js *Jobserver) Auth() string {
+	if js.fifo != "" {
+		return "fifo:" + js.fifo
+	}
+	return "3,4"
+}
+
+// Files returns the files that sub-makes must inherit, for the pipe style
+func (js *Jobserver) Files() []*os.File {
+	if js.fifo != "" {
+		return nil
+	}
+	return []*os.File{js.read, js.write}
+}
+
+// Acquire waits for a job slot. The implicit slot is used if it is free,
+// otherwise a token is read from the jobserver.
+func (js *Jobserver) Acquire() error {
+	js.mut.Lock()
+	if !js.implicit {
+		js.implicit = true
+		js.mut.Unlock()
+		return nil
+	}
+	js.mut.Unlock()
+	token := make([]byte, 1)
+	for {
+		n, err := js.read.Read(token)
+		if n == 1 {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	js.mut.Lock()
+	js.tokens = append(js.tokens, token[0])
+	js.mut.Unlock()
+	return nil
+}
+
+// Release gives back a job slot, by writing a token back to the jobserver if one is held,
+// or by freeing the implicit slot
+func (js *Jobserver) Release() error {
+	js.mut.Lock()
+	if len(js.tokens) == 0 {
+		js.implicit = false
+		js.mut.Unlock()
+		return nil
+	}
+	token := js.tokens[len(js.tokens)-1]
+	js.tokens = js.tokens[:len(js.tokens)-1]
+	js.mut.Unlock()
+	_, err := js.write.Write([]byte{token})
+	return err
+}
+
+// Close closes the jobserver, and removes the named pipe if this make created it
+func (js *Jobserver) Close() error {
+	err := js.read.Close()
+	if js.write != js.read {
+		js.write.Close()
+	}
+	if js.owner && js.fifo != "" {
+		os.Remove(js.fifo)
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package exec
+
+import (
+	"os"
+	osexec "os/exec"
+	"strings"
+	"syscall"
+)
+
+// setGroup makes the command run in a process group of its own
+func setGroup(cmd *osexec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killGroup sends the given signal to the process group of the command
+func killGroup(cmd *osexec.Cmd, sig os.Signal) {
+	if s, ok := sig.(syscall.Signal); ok && cmd.Process != nil {
+		syscall.Kill(-cmd.Process.Pid, s)
+	}
+}
+
+// signaled returns the description of the signal that killed the command, like "Terminated"
+// or "Segmentation fault (core dumped)", or "" if it was not killed by a signal
+func signaled(err *osexec.ExitError) string {
+	status, ok := err.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return ""
+	}
+	description := status.Signal().String()
+	if description != "" {
+		description = strings.ToUpper(description[:1]) + description[1:]
+	}
+	if status.CoreDump() {
+		description += " (core dumped)"
+	}
+	return description
+}
@@ -0,0 +1,21 @@
+package exec
+
+import (
+	"os"
+	osexec "os/exec"
+)
+
+// setGroup does nothing on Windows, where there are no process groups like on Unix
+func setGroup(cmd *osexec.Cmd) {}
+
+// killGroup kills the command, since signals can not be sent on Windows
+func killGroup(cmd *osexec.Cmd, sig os.Signal) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// signaled returns "", since commands are not killed by signals on Windows
+func signaled(err *osexec.ExitError) string {
+	return ""
+}
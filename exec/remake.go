@@ -0,0 +1,63 @@
+package exec
+
+import (
+	"github.com/xyproto/ake/graph"
+)
+
+// Remake makes the given makefiles, before any goals are made, so that makefiles that are out
+// of date or do not exist yet can be made and read again. A makefile that does not exist and
+// has no rule is not an error here, since it may be optional. The makefiles are made in the
+// reverse order of how they were read, as GNU Make does. A makefile with a "::" rule that has
+// a recipe but no prerequisites is not remade, since it would be remade every time.
+// Errors from the recipes of optional makefiles, which are included with "-include", are
+// ignored and not reported. Returns the makefiles that were changed, and ErrFailed if a
+// makefile could not be made, or an *InterruptedError if a signal was received.
+func (e *Executor) Remake(makefiles, optional []string) (changed []string, err error) {
+	e.remaking = true
+	e.optional = names(optional)
+	if err := e.expandAll(); err != nil {
+		return nil, err
+	}
+	defer e.watchSignals()()
+	defer e.removeIntermediates()
+	for i := len(makefiles) - 1; i >= 0; i-- {
+		name := makefiles[i]
+		if sig := e.signal(); sig != nil {
+			return changed, e.interruptedError(sig)
+		}
+		if t := e.db.Graph.Lookup(name); t != nil && mightLoop(t) {
+			e.debugf(e.options.Debug.Verbose, 0, "Makefile '%s' might loop; not remaking it.", name)
+			continue
+		}
+		before, existed := e.stat(name)
+		n := e.build(name, nil, nil)
+		if sig := e.signal(); sig != nil {
+			return changed, e.interruptedError(sig)
+		}
+		if n.err != nil && n.err != errNoRule && !e.optional[name] {
+			err = ErrFailed
+			if !e.options.KeepGoing {
+				return changed, err
+			}
+			continue
+		}
+		if after, exists := e.stat(name); exists && (!existed || !after.Equal(before)) {
+			changed = append(changed, name)
+		}
+	}
+	return changed, err
+}
+
+// mightLoop checks if the target has a "::" rule with a recipe and no prerequisites,
+// which always runs its recipe
+func mightLoop(t *graph.Target) bool {
+	if !t.DoubleColon {
+		return false
+	}
+	for _, rule := range t.Rules {
+		if rule.Recipe != nil && len(rule.Normal) == 0 && len(rule.OrderOnly) == 0 {
+			return true
+		}
+	}
+	return false
+}
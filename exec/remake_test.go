@@ -0,0 +1,43 @@
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestRemake checks which makefiles are remade and reported as changed, so that make restarts
+func TestRemake(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	makefile := fmt.Sprintf("%[1]s/inc.mk: %[1]s/inc.in\n\t@echo made > $@\n%[1]s/inc.in:\n\t@touch $@\n"+
+		"%[1]s/loop.mk::\n\t@touch $@\n%[1]s/bad.mk:\n\t@false\n", dir)
+	for _, test := range []struct {
+		name                string
+		makefiles, optional []string
+		changed             []string
+		err                 error
+	}{
+		{"missing", []string{path("inc.mk")}, nil, []string{path("inc.mk")}, nil},
+		{"up to date", []string{path("inc.mk")}, nil, nil, nil},
+		{"no rule", []string{path("none.mk")}, nil, nil, nil},
+		{"might loop", []string{path("loop.mk")}, nil, nil, nil},
+		{"failed", []string{path("bad.mk"), path("inc.mk")}, nil, nil, ErrFailed},
+		{"failed optional", []string{path("bad.mk")}, []string{path("bad.mk")}, nil, nil},
+	} {
+		var stdout, stderr bytes.Buffer
+		changed, err := New(load(t, makefile), Options{Stdout: &stdout, Stderr: &stderr}).Remake(test.makefiles, test.optional)
+		if err != test.err || !reflect.DeepEqual(changed, test.changed) {
+			t.Errorf("%s: Remake returned %q and %v, want %q and %v, stderr is %q",
+				test.name, changed, err, test.changed, test.err, stderr.String())
+		}
+	}
+	if _, err := os.Stat(path("loop.mk")); !os.IsNotExist(err) {
+		t.Errorf("the makefile with a \"::\" rule without prerequisites was made")
+	}
+}
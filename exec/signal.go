@@ -0,0 +1,127 @@
+package exec
+
+import (
+	"fmt"
+	"os"
+	osexec "os/exec"
+
+	"github.com/xyproto/ake/graph"
+)
+
+// watchSignals waits for signals from Options.Interrupt while goals are made.
+// Returns a function that stops waiting.
+func (e *Executor) watchSignals() func() {
+	if e.options.Interrupt == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case sig := <-e.options.Interrupt:
+			e.interrupt(sig)
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// signal returns the signal that was received, or nil
+func (e *Executor) signal() os.Signal {
+	e.signalMut.Lock()
+	defer e.signalMut.Unlock()
+	return e.interrupted
+}
+
+// interrupt kills the process groups of the running commands, and deletes the targets
+// they were making, unless they are precious, phony or archive members, or were not changed yet
+func (e *Executor) interrupt(sig os.Signal) {
+	e.signalMut.Lock()
+	defer e.signalMut.Unlock()
+	if e.interrupted != nil {
+		return
+	}
+	e.interrupted = sig
+	// Everything that is waiting stops once the targets have been deleted
+	defer close(e.stopped)
+	for cmd, j := range e.running {
+		killGroup(cmd, sig)
+		if j.target.Precious || j.target.Phony || graph.IsMember(j.target.Name) {
+			// Archive members are never deleted, since that would delete the archive
+			continue
+		}
+		mtime, exists := e.stat(j.target.Name)
+		if !exists || (j.existed && mtime.Equal(j.mtime)) {
+			continue
+		}
+		fmt.Fprintf(e.options.Stderr, "%s: *** Deleting file '%s'\n", e.db.Program(), j.target.Name)
+		os.Remove(j.target.Name)
+	}
+}
+
+// startRecipe registers a recipe that is about to run, so that it is waited for after a signal.
+// Returns false if a signal has already been received, and the recipe must not run.
+func (e *Executor) startRecipe() bool {
+	e.signalMut.Lock()
+	defer e.signalMut.Unlock()
+	if e.interrupted != nil {
+		return false
+	}
+	e.recipes.Add(1)
+	return true
+}
+
+// interruptedError waits for the recipes that were running when the given signal was
+// received, and have been killed, so that their errors are reported, and returns the
+// error for the signal. Nothing else is waited for.
+func (e *Executor) interruptedError(sig os.Signal) error {
+	e.recipes.Wait()
+	return &InterruptedError{sig}
+}
+
+// acquire waits for a job slot from the jobserver, or until a signal is received, in which
+// case errInterrupted is returned. A slot that is acquired after the signal is given back
+// right away, so that the other makes sharing the jobserver do not lose it.
+func (e *Executor) acquire(js *Jobserver) error {
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- js.Acquire()
+	}()
+	select {
+	case err := <-acquired:
+		return err
+	case <-e.stopped:
+		go func() {
+			if <-acquired == nil {
+				js.Release()
+			}
+		}()
+		return errInterrupted
+	}
+}
+
+// startCommand registers a command that has been started for the given job, so that it
+// can be killed if a signal is received. If a signal has already been received, the
+// command is killed right away.
+func (e *Executor) startCommand(cmd *osexec.Cmd, j *job) {
+	e.signalMut.Lock()
+	defer e.signalMut.Unlock()
+	if e.interrupted != nil {
+		killGroup(cmd, e.interrupted)
+		return
+	}
+	e.running[cmd] = j
+}
+
+// finishCommand unregisters a command that has finished. If a signal was received,
+// this waits until the targets of the running commands have been deleted, so that
+// they are reported before the commands that were killed.
+func (e *Executor) finishCommand(cmd *osexec.Cmd) {
+	e.signalMut.Lock()
+	defer e.signalMut.Unlock()
+	delete(e.running, cmd)
+}
@@ -0,0 +1,143 @@
+//go:build !windows
+// +build !windows
+
+package exec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// signalMakefile makes two targets in the given directory, with recipes that write the
+// process group ID and the target, and then sleep until they are killed. Only y is precious.
+const signalMakefile = `all: %[1]s/x %[1]s/y
+%[1]s/x %[1]s/y:
+	echo $$$$ > $@.pgid; echo data > $@; exec sleep 30
+.PRECIOUS: %[1]s/y
+`
+
+// waitFor waits until the given condition is true, for up to 10 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(10 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// TestInterrupt sends signals while recipes are running, and checks that the process groups
+// of the recipes are killed, that the target that is not precious is deleted, and that
+// Run returns an *InterruptedError
+func TestInterrupt(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGTERM} {
+		t.Run(sig.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			db := load(t, fmt.Sprintf(signalMakefile, dir))
+			interrupt := make(chan os.Signal, 1)
+			var stderr bytes.Buffer
+			options := Options{Jobs: 2, Stdout: ioutil.Discard, Stderr: &stderr, Interrupt: interrupt}
+			done := make(chan error, 1)
+			go func() {
+				done <- Run(db, options)
+			}()
+
+			x, y := filepath.Join(dir, "x"), filepath.Join(dir, "y")
+			var groups []int
+			for _, name := range []string{x, y} {
+				name := name
+				waitFor(t, name, func() bool {
+					_, err := os.Stat(name)
+					return err == nil
+				})
+				var pgid int
+				waitFor(t, name+".pgid", func() bool {
+					data, err := ioutil.ReadFile(name + ".pgid")
+					if err != nil {
+						return false
+					}
+					pgid, err = strconv.Atoi(strings.TrimSpace(string(data)))
+					return err == nil
+				})
+				groups = append(groups, pgid)
+			}
+
+			interrupt <- sig
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("Run did not return after the signal")
+			}
+			var interrupted *InterruptedError
+			if !errors.As(err, &interrupted) {
+				t.Fatalf("Run returned %v, not an *InterruptedError", err)
+			}
+			if interrupted.Signal != sig {
+				t.Errorf("Run returned the signal %v, not %v", interrupted.Signal, sig)
+			}
+
+			for _, pgid := range groups {
+				waitFor(t, "process group "+strconv.Itoa(pgid)+" to be gone", func() bool {
+					return syscall.Kill(-pgid, 0) == syscall.ESRCH
+				})
+			}
+			if _, err := os.Stat(x); !os.IsNotExist(err) {
+				t.Errorf("%s was not deleted", x)
+			}
+			if want := fmt.Sprintf("make: *** Deleting file '%s'\n", x); !strings.Contains(stderr.String(), want) {
+				t.Errorf("stderr is %q, without %q", stderr.String(), want)
+			}
+			if _, err := os.Stat(y); err != nil {
+				t.Errorf("the precious target %s was deleted", y)
+			}
+			if strings.Contains(stderr.String(), "Deleting file '"+y+"'") {
+				t.Errorf("stderr is %q, but %s is precious", stderr.String(), y)
+			}
+		})
+	}
+}
+
+// TestInterruptWaiting sends a signal while one recipe is running and another is waiting
+// for a job slot from the jobserver, which is never given back, and checks that Run
+// still returns an *InterruptedError
+func TestInterruptWaiting(t *testing.T) {
+	dir := t.TempDir()
+	js, err := NewJobserver(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer js.Close()
+	interrupt := make(chan os.Signal, 1)
+	var stderr bytes.Buffer
+	options := Options{Jobs: 2, Jobserver: js, Stdout: ioutil.Discard, Stderr: &stderr, Interrupt: interrupt}
+	db := load(t, fmt.Sprintf(signalMakefile, dir))
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(db, options)
+	}()
+	waitFor(t, "a recipe to start", func() bool {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.pgid"))
+		return len(matches) > 0
+	})
+	// The other recipe is waiting for a job slot by now
+	time.Sleep(100 * time.Millisecond)
+	interrupt <- syscall.SIGTERM
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after the signal")
+	}
+	var interrupted *InterruptedError
+	if !errors.As(err, &interrupted) {
+		t.Fatalf("Run returned %v, not an *InterruptedError", err)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/xyproto/ake/parse"
+	"github.com/xyproto/makeflags"
+)
+
+// flagValues returns all the values that are given for the flags with the given names, in order.
+// makeflags only keeps the last value of each flag, while flags like -o and -W may be
+// given several times. The flags may be given as "-o FILE", "-oFILE", "-o=FILE", "--old-file FILE"
+// or "--old-file=FILE", and the arguments after "--" are not searched.
+func flagValues(args []string, names ...string) []string {
+	var values []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		value, hasValue := "", false
+		if attachedValue(arg) {
+			name, value, hasValue = arg[1:2], arg[2:], true
+		} else if pos := strings.Index(name, "="); pos != -1 {
+			name, value, hasValue = name[:pos], name[pos+1:], true
+		}
+		if !containsString(names, name) {
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				break
+			}
+			i++
+			value = args[i]
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// containsString checks if the given slice of strings contains the given string
+func containsString(xs []string, x string) bool {
+	for _, s := range xs {
+		if s == x {
+			return true
+		}
+	}
+	return false
+}
+
+// splitArguments splits the arguments after the flags into goals and variable assignments,
+// like "all" and "CFLAGS=-O2"
+func splitArguments(args []string) (goals, variables []string) {
+	for _, arg := range args {
+		if parse.NewAssignment(arg) != nil {
+			variables = append(variables, arg)
+		} else {
+			goals = append(goals, arg)
+		}
+	}
+	return goals, variables
+}
+
+// letterFlags are the flags without values that are passed on to sub-makes in $(MAKEFLAGS),
+// as single letters, in the order GNU Make gives them
+var letterFlags = []struct {
+	letter string
+	set    func(config *makeflags.Config) bool
+}{
+	{"B", func(c *makeflags.Config) bool { return c.AlwaysMake }},
+	{"d", func(c *makeflags.Config) bool { return c.DebugInfo }},
+	{"e", func(c *makeflags.Config) bool { return c.EnvironmentOverride }},
+	{"i", func(c *makeflags.Config) bool { return c.IgnoreErrors }},
+	{"k", func(c *makeflags.Config) bool { return c.KeepGoing }},
+	{"L", func(c *makeflags.Config) bool { return c.CheckSymlinkTime }},
+	{"n", func(c *makeflags.Config) bool { return c.DryRun }},
+	{"p", func(c *makeflags.Config) bool { return c.PrintInternalDB }},
+	{"q", func(c *makeflags.Config) bool { return c.StatusOnly }},
+	{"r", func(c *makeflags.Config) bool { return c.NoBuiltinRules }},
+	{"R", func(c *makeflags.Config) bool { return c.NoBuiltinVars }},
+	{"s", func(c *makeflags.Config) bool { return c.Silent }},
+	{"t", func(c *makeflags.Config) bool { return c.TouchTargets }},
+	{"w", func(c *makeflags.Config) bool { return c.PrintDirectory }},
+}
+
+// makeFlags returns the value of $(MAKEFLAGS), with the flags that sub-makes should get,
+// like "ks -I/usr/include -j4 --jobserver-auth=3,4 -- CFLAGS=-O2". The first word is the single letter flags,
+// and the command line variables are given after "--", in reverse order, as GNU Make does.
+// The arguments are searched for flags that may be given several times, like -I.
+func makeFlags(config *makeflags.Config, args, variables []string, jobserverAuth string) string {
+	var letters strings.Builder
+	for _, f := range letterFlags {
+		if f.set(config) {
+			letters.WriteString(f.letter)
+		}
+	}
+	words := []string{letters.String()}
+	for _, dir := range flagValues(args, "I", "include-dir") {
+		words = append(words, "-I"+quoteFlag(dir))
+	}
+	if config.Jobs == unlimitedJobs {
+		words = append(words, "-j")
+	} else if config.Jobs != defaultJobs && config.Jobs > 1 {
+		words = append(words, "-j"+strconv.Itoa(config.Jobs))
+	}
+	if jobserverAuth != "" {
+		words = append(words, "--jobserver-auth="+jobserverAuth)
+	}
+	if config.DebugFlags != "" {
+		words = append(words, "--debug="+quoteFlag(config.DebugFlags))
+	}
+	if config.PrintTrace {
+		words = append(words, "--trace")
+	}
+	if config.WarnUndefined {
+		words = append(words, "--warn-undefined-variables")
+	}
+	if containsString(args, "--no-print-directory") || containsString(args, "-no-print-directory") {
+		words = append(words, "--no-print-directory")
+	}
+	for _, text := range flagValues(args, "eval") {
+		words = append(words, "--eval="+quoteFlag(text))
+	}
+	if len(variables) > 0 {
+		words = append(words, "--")
+		for i := len(variables) - 1; i >= 0; i-- {
+			words = append(words, quoteFlag(variables[i]))
+		}
+	}
+	if len(words) == 1 && words[0] == "" {
+		return ""
+	}
+	return strings.Join(words, " ")
+}
+
+// valueFlags are the flags in $(MAKEFLAGS) that have the value right after the letter, like -I/usr/include
+var valueFlags = []string{"C", "f", "I", "j", "l", "o", "O", "W"}
+
+// attachedValue checks if the given argument is a single letter flag with the value right
+// after the letter, like -j4 or -Wfoo.c, and not a long flag given with a single "-", like -jobs=4
+func attachedValue(arg string) bool {
+	if strings.HasPrefix(arg, "--") || len(arg) < 3 || arg[0] != '-' || arg[2] == '=' || !containsString(valueFlags, arg[1:2]) {
+		return false
+	}
+	name := arg[1:]
+	if pos := strings.Index(name, "="); pos != -1 {
+		name = name[:pos]
+	}
+	// -just-print is the only long flag without a value that starts with one of the letters
+	return !containsString(stringFlags, name) && name != "just-print"
+}
+
+// longFlags are the long flags in $(MAKEFLAGS) that are understood by makeflags
+var longFlags = []string{"--debug", "--trace", "--warn-undefined-variables", "--no-print-directory", "--eval"}
+
+// parseMakeFlags turns the value of $(MAKEFLAGS) from the environment, as given by a parent make,
+// into flags for makeflags and command line variables. Flags that are not known are skipped.
+func parseMakeFlags(value string) (flags, variables []string) {
+	words := splitFlags(value)
+	if len(words) > 0 && !strings.HasPrefix(words[0], "-") && !strings.Contains(words[0], "=") {
+		// The single letter flags, like "ks"
+		for _, letter := range words[0] {
+			for _, f := range letterFlags {
+				if f.letter == string(letter) {
+					flags = append(flags, "-"+f.letter)
+				}
+			}
+		}
+		words = words[1:]
+	}
+	for i, word := range words {
+		switch {
+		case word == "--":
+			return flags, append(variables, words[i+1:]...)
+		case strings.HasPrefix(word, "--"):
+			name := word
+			if pos := strings.Index(word, "="); pos != -1 {
+				name = word[:pos]
+			}
+			if containsString(longFlags, name) {
+				flags = append(flags, word)
+			}
+		case attachedValue(word):
+			// makeflags needs "-I=dir" instead of "-Idir"
+			flags = append(flags, word[:2]+"="+word[2:])
+		case strings.HasPrefix(word, "-"):
+			flags = append(flags, word)
+		default:
+			// Variables may also be given without "--", as in "MAKEFLAGS=CFLAGS=-O2"
+			variables = append(variables, word)
+		}
+	}
+	return flags, variables
+}
+
+// splitFlags splits the value of $(MAKEFLAGS) into words, where whitespace and backslashes
+// that are escaped with a backslash are part of the word
+func splitFlags(value string) []string {
+	var (
+		words   []string
+		current strings.Builder
+		escaped bool
+	)
+	for _, r := range value {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if current.Len() > 0 {
+				words = append(words, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		words = append(words, current.String())
+	}
+	return words
+}
+
+// quoteFlag escapes whitespace and backslashes with a backslash, so that a word
+// in $(MAKEFLAGS) can be split from the other words again
+func quoteFlag(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch r {
+		case ' ', '\t', '\n', '\\':
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// stringFlags are the flags of makeflags that take a value, which may be the next argument
+var stringFlags = []string{
+	"C", "directory", "eval", "f", "file", "makefile", "I", "include-dir",
+	"j", "jobs", "l", "load-average", "max-load", "o", "old-file", "assume-old",
+	"O", "output-sync", "W", "what-if", "new-file", "assume-new",
+}
+
+// reorderArguments moves goals and variable assignments after the flags, since make allows
+// them to be mixed, as in "make all -k", while makeflags stops at the first argument that
+// is not a flag. Flags with the value right after the letter, like -j4, are given an "=".
+// Everything after "--" is kept as it is.
+func reorderArguments(args []string) []string {
+	var flags, rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return append(append(flags, rest...), args[i:]...)
+		case arg == "-" || !strings.HasPrefix(arg, "-"):
+			rest = append(rest, arg)
+		case arg == "--debug" || arg == "-debug":
+			// The value of --debug is optional, and must be given with "="
+			flags = append(flags, "--debug=b")
+		case attachedValue(arg):
+			// makeflags needs "-j=4" instead of "-j4"
+			flags = append(flags, arg[:2]+"="+arg[2:])
+		default:
+			flags = append(flags, arg)
+			name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+			if !strings.Contains(name, "=") && containsString(stringFlags, name) && i+1 < len(args) {
+				i++
+				flags = append(flags, args[i])
+			}
+		}
+	}
+	return append(flags, rest...)
+}
+
+// jobserverAuth returns the value of --jobserver-auth in the given $(MAKEFLAGS), or of
+// --jobserver-fds, as older versions of GNU Make give it. Returns "" if there is none.
+func jobserverAuth(value string) string {
+	auth := ""
+	for _, word := range splitFlags(value) {
+		if word == "--" {
+			break
+		}
+		for _, prefix := range []string{"--jobserver-auth=", "--jobserver-fds="} {
+			if strings.HasPrefix(word, prefix) {
+				auth = strings.TrimPrefix(word, prefix)
+			}
+		}
+	}
+	return auth
+}
+
+// removeUnlimitedJobs removes -j and --jobs without a number from the arguments, since
+// makeflags needs a number, and reports if there was one. As with make, the argument after
+// -j is only its value if it is a number, so "-j all" is unlimited jobs and the goal "all".
+func removeUnlimitedJobs(args []string) (bool, []string) {
+	unlimited := false
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return unlimited, append(rest, args[i:]...)
+		}
+		if arg != "-j" && arg != "--jobs" && arg != "-jobs" {
+			rest = append(rest, arg)
+			continue
+		}
+		if i+1 < len(args) {
+			if n, err := strconv.Atoi(args[i+1]); err == nil && n > 0 {
+				rest = append(rest, arg, args[i+1])
+				i++
+				unlimited = false
+				continue
+			}
+		}
+		unlimited = true
+	}
+	return unlimited, rest
+}
+
+// removeFlag removes the flag with the given name, and its value, from the arguments.
+// Returns the last value that was given, and the remaining arguments.
+func removeFlag(args []string, name string) (string, []string) {
+	value := ""
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return value, append(rest, args[i:]...)
+		}
+		trimmed := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		switch {
+		case !strings.HasPrefix(arg, "-"):
+			rest = append(rest, arg)
+		case strings.HasPrefix(trimmed, name+"="):
+			value = strings.TrimPrefix(trimmed, name+"=")
+		case trimmed == name && i+1 < len(args):
+			i++
+			value = args[i]
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return value, rest
+}
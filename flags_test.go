@@ -0,0 +1,142 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xyproto/makeflags"
+)
+
+// TestParseMakeFlagsUnlimitedJobs checks that -j without a number from a parent make,
+// as GNU Make gives it for "make -j", is unlimited jobs, and not an error
+func TestParseMakeFlagsUnlimitedJobs(t *testing.T) {
+	flags, variables := parseMakeFlags(" -j --jobserver-auth=3,4")
+	if len(variables) != 0 {
+		t.Errorf("the variables are %q", variables)
+	}
+	unlimited, rest := removeUnlimitedJobs(flags)
+	if !unlimited || len(rest) != 0 {
+		t.Errorf("the flags %q are %q, and unlimited is %v", flags, rest, unlimited)
+	}
+	if auth := jobserverAuth(" -j --jobserver-auth=3,4"); auth != "3,4" {
+		t.Errorf("the jobserver auth is %q", auth)
+	}
+}
+
+// TestRemoveUnlimitedJobs checks that the argument after -j is only its value if it is a number
+func TestRemoveUnlimitedJobs(t *testing.T) {
+	for _, test := range []struct {
+		args, rest string
+		unlimited  bool
+	}{
+		{"-j", "", true},
+		{"-j all", "all", true},
+		{"-j -k all", "-k all", true},
+		{"--jobs", "", true},
+		{"-j 4 all", "-j 4 all", false},
+		{"-j4 all", "-j4 all", false},
+		{"-j -j 2", "-j 2", false},
+		{"-- -j", "-- -j", false},
+	} {
+		unlimited, rest := removeUnlimitedJobs(strings.Fields(test.args))
+		if unlimited != test.unlimited || strings.Join(rest, " ") != test.rest {
+			t.Errorf("%q: got %q and %v, want %q and %v", test.args, rest, unlimited, test.rest, test.unlimited)
+		}
+	}
+}
+
+// TestReorderArguments checks that goals come after the flags, and that values
+// right after the letter of a flag are given with "="
+func TestReorderArguments(t *testing.T) {
+	for _, test := range []struct {
+		args, want string
+	}{
+		{"all -k", "-k all"},
+		{"-j4 all", "-j=4 all"},
+		{"-Wa.c -oa.c -fmk -Csub", "-W=a.c -o=a.c -f=mk -C=sub"},
+		{"-C sub all", "-C sub all"},
+		{"-jobs=2 -just-print", "-jobs=2 -just-print"},
+		{"all -- -k", "all -- -k"},
+	} {
+		if got := reorderArguments(strings.Fields(test.args)); !reflect.DeepEqual(got, strings.Fields(test.want)) {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+// TestFlagValues checks that flags which may be given more than once, like -W and -o,
+// give all of their values, in order
+func TestFlagValues(t *testing.T) {
+	args := reorderArguments(strings.Fields("-Wa.c all -W b.c --what-if=c.c -oa.o -o b.o --assume-old=c.o"))
+	if got, want := flagValues(args, "W", "what-if", "new-file", "assume-new"), []string{"a.c", "b.c", "c.c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the new files are %q, want %q", got, want)
+	}
+	if got, want := flagValues(args, "o", "old-file", "assume-old"), []string{"a.o", "b.o", "c.o"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the old files are %q, want %q", got, want)
+	}
+}
+
+// TestDirectories checks that the directories of several -C flags are all given, in order,
+// so that they can be entered one after the other
+func TestDirectories(t *testing.T) {
+	for _, test := range []struct {
+		args string
+		want []string
+	}{
+		{"all", nil},
+		{"-C sub all", []string{"sub"}},
+		{"-Ca -C b --directory=c all", []string{"a", "b", "c"}},
+		{"-C .. -C sub", []string{"..", "sub"}},
+		{"-C a -- -C b", []string{"a"}},
+	} {
+		got := flagValues(reorderArguments(strings.Fields(test.args)), "C", "directory")
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+// TestSplitArguments checks that variable assignments on the command line are not goals
+func TestSplitArguments(t *testing.T) {
+	goals, variables := splitArguments([]string{"CFLAGS=-O0", "all", "X:=1", "install", "Y+=2", "override=3", "Z?=a b"})
+	if want := []string{"all", "install"}; !reflect.DeepEqual(goals, want) {
+		t.Errorf("the goals are %q, want %q", goals, want)
+	}
+	if want := []string{"CFLAGS=-O0", "X:=1", "Y+=2", "override=3", "Z?=a b"}; !reflect.DeepEqual(variables, want) {
+		t.Errorf("the variables are %q, want %q", variables, want)
+	}
+}
+
+// TestMakeFlags checks $(MAKEFLAGS) against what GNU Make gives for the same flags,
+// and that parseMakeFlags gives the flags and variables back
+func TestMakeFlags(t *testing.T) {
+	for _, test := range []struct {
+		config    makeflags.Config
+		args      string
+		variables []string
+		auth      string
+		want      string
+	}{
+		{makeflags.Config{Jobs: defaultJobs}, "", nil, "", ""},
+		{makeflags.Config{Jobs: defaultJobs, DryRun: true, EnvironmentOverride: true}, "-n -e", nil, "", "en"},
+		{makeflags.Config{Jobs: defaultJobs, KeepGoing: true, Silent: true, IgnoreErrors: true},
+			"-k -s -i -I inc --no-print-directory", []string{"CFLAGS=a b", "X=1"}, "",
+			`iks -Iinc --no-print-directory -- X=1 CFLAGS=a\ b`},
+		{makeflags.Config{Jobs: 4}, "-j=4", nil, "3,4", " -j4 --jobserver-auth=3,4"},
+		{makeflags.Config{Jobs: unlimitedJobs}, "", nil, "", " -j"},
+		{makeflags.Config{Jobs: defaultJobs, PrintTrace: true}, "--trace --eval=X=1", nil, "", " --trace --eval=X=1"},
+	} {
+		got := makeFlags(&test.config, reorderArguments(strings.Fields(test.args)), test.variables, test.auth)
+		if got != test.want {
+			t.Errorf("%q: $(MAKEFLAGS) is %q, want %q", test.args, got, test.want)
+		}
+	}
+	flags, variables := parseMakeFlags(`iks -Iinc --no-print-directory -- X=1 CFLAGS=a\ b`)
+	if want := []string{"-i", "-k", "-s", "-I=inc", "--no-print-directory"}; !reflect.DeepEqual(flags, want) {
+		t.Errorf("the flags are %q, want %q", flags, want)
+	}
+	if want := []string{"X=1", "CFLAGS=a b"}; !reflect.DeepEqual(variables, want) {
+		t.Errorf("the variables are %q, want %q", variables, want)
+	}
+}
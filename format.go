@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xyproto/ake/eval"
+	"github.com/xyproto/ake/format"
+	"github.com/xyproto/ake/parse"
+)
+
+// formatArguments finds "fmt" or "--fmt" in the arguments ake was started with, where "fmt"
+// is the first argument that is not a flag or the value of one, and "--fmt" may come after
+// flags as well. Returns the flags before it, the arguments after it, and if "--fmt" was used.
+func formatArguments(args []string) (flags, rest []string, explicit, found bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--fmt":
+			return args[:i], args[i+1:], true, true
+		case arg == "fmt":
+			return args[:i], args[i+1:], false, true
+		case arg == "--" || arg == "-" || !strings.HasPrefix(arg, "-"):
+			return nil, nil, false, false
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if !containsString(stringFlags, name) || i+1 == len(args) {
+			continue
+		}
+		if _, err := strconv.Atoi(args[i+1]); (name == "j" || name == "jobs") && err != nil {
+			// -j without a number, as in "ake -j fmt"
+			continue
+		}
+		i++
+	}
+	return nil, nil, false, false
+}
+
+// formatMode checks if ake is run as "ake fmt" or "ake --fmt", and returns the arguments for
+// formatMakefiles, after changing to the directories given with -C. The makefiles given
+// with -f are formatted, if no makefiles are given after "fmt". "ake fmt" makes the goal
+// "fmt" instead if the makefile has a rule for it, outside of included makefiles,
+// so "ake --fmt" always formats.
+func formatMode(args []string) ([]string, bool) {
+	flags, rest, explicit, found := formatArguments(args)
+	if !found {
+		return nil, false
+	}
+	_, flags = removeUnlimitedJobs(flags)
+	flags = reorderArguments(flags)
+	start, _ := os.Getwd()
+	for _, dir := range flagValues(flags, "C", "directory") {
+		if err := os.Chdir(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: *** %s: No such file or directory.  Stop.\n", program(), dir)
+			os.Exit(2)
+		}
+	}
+	makefiles := flagValues(flags, "f", "file", "makefile")
+	if !explicit && hasRule(makefiles, "fmt") {
+		os.Chdir(start)
+		return nil, false
+	}
+	return append(rest, makefiles...), true
+}
+
+// hasRule checks if one of the given makefiles, or the makefile that would be read if none
+// are given, has a rule for the target with the given name. The makefiles are only parsed,
+// so targets that come from variables or included makefiles are not found.
+func hasRule(makefiles []string, target string) bool {
+	if len(makefiles) == 0 {
+		makefiles = defaultMakefile()
+	}
+	for _, name := range makefiles {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		if nodesHaveRule(parse.ParseString(filepath.Base(name), string(data)).Nodes, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodesHaveRule checks if the given nodes, or the nodes within conditionals, have a rule for the given target
+func nodesHaveRule(nodes []parse.Node, target string) bool {
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *parse.Rule:
+			if n.Variable == nil && containsString(n.Targets, target) {
+				return true
+			}
+		case *parse.Conditional:
+			for _, branch := range n.Branches {
+				if nodesHaveRule(branch.Nodes, target) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// defaultMakefile returns the makefile that is read when none is given, as a slice, or nil if there is none
+func defaultMakefile() []string {
+	for _, name := range []string{"GNUmakefile", "makefile", "Makefile"} {
+		if _, err := os.Stat(name); err == nil {
+			return []string{name}
+		}
+	}
+	return nil
+}
+
+// formatMakefiles is "ake fmt", which formats the given makefiles, or the makefile that would
+// be read if none are given. The formatted makefiles are written to stdout, or back to the
+// files with -w. Each makefile is evaluated both before and after it is formatted, and is
+// only formatted if the evaluated databases are the same. Returns the exit status.
+func formatMakefiles(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	write := flags.Bool("w", false, "Write the result to the makefile instead of to stdout")
+	list := flags.Bool("l", false, "List the makefiles that are not formatted")
+	sortPhony := flags.Bool("sort-phony", false, "Sort the names given to .PHONY")
+	indent := flags.Int("indent", format.DefaultOptions.Indent, "Indent lines within conditionals by N spaces per level")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [-C dir] [-f makefile] fmt|--fmt [flags] [makefile ...]\n", program())
+		flags.PrintDefaults()
+		fmt.Fprintln(flags.Output(), "Each makefile is evaluated before and after it is formatted, so $(shell ...) is run twice.")
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	options := format.Options{Indent: *indent, SortPhony: *sortPhony}
+	makefiles := flags.Args()
+	if len(makefiles) == 0 {
+		makefiles = defaultMakefile()
+	}
+	if len(makefiles) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: *** No makefile found.  Stop.\n", program())
+		return 2
+	}
+	status := 0
+	for _, name := range makefiles {
+		if err := formatMakefile(name, options, *write, *list); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", program(), err)
+			status = 2
+		}
+	}
+	return status
+}
+
+// formatMakefile formats a single makefile, as given to "ake fmt"
+func formatMakefile(name string, options format.Options, write, list bool) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	original := string(data)
+	file := parse.ParseString(name, original)
+	if len(file.Diagnostics) > 0 {
+		return file.Diagnostics
+	}
+	formatted := format.File(file, options)
+	if formatted != original {
+		if err := sameMeaning(name, original, formatted); err != nil {
+			return err
+		}
+	}
+	if list {
+		if formatted != original {
+			fmt.Println(name)
+		}
+		return nil
+	}
+	if !write {
+		_, err := os.Stdout.WriteString(formatted)
+		return err
+	}
+	if formatted == original {
+		return nil
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, []byte(formatted), info.Mode())
+}
+
+// sameMeaning evaluates the original and the formatted text of a makefile, and returns
+// an error if the evaluated databases differ, or if they could not be evaluated.
+// Included makefiles are read, and $(shell ...) is run, as when the makefile is used,
+// so the commands given to $(shell ...) are run twice, once for each text.
+func sameMeaning(name, original, formatted string) error {
+	before, err := evaluated(name, original)
+	if err != nil {
+		return fmt.Errorf("%s: could not be evaluated, so it is not formatted: %v", name, err)
+	}
+	after, err := evaluated(name, formatted)
+	if err != nil {
+		return fmt.Errorf("%s: could not be evaluated after formatting, so it is not formatted: %v", name, err)
+	}
+	if before != after {
+		return fmt.Errorf("%s: formatting would change the evaluated makefile, so it is not formatted", name)
+	}
+	return nil
+}
+
+// evaluated evaluates the given text of a makefile, and returns the database as printed
+// by "make -p", with the parts that are expected to change when a makefile is formatted
+// made the same: the times the database was printed, the order of the files, which follows
+// the order targets are first mentioned in, and the order of the names given to .PHONY.
+func evaluated(name, text string) (string, error) {
+	db := eval.New(eval.Options{
+		Environment:  os.Environ(),
+		AllowMissing: true,
+		Stdout:       ioutil.Discard,
+		Stderr:       ioutil.Discard,
+	})
+	if err := db.Read(parse.ParseString(name, text)); err != nil {
+		return "", err
+	}
+	if err := db.Finish(); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := db.Print(&buf); err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "# Make data base, printed on ") || strings.HasPrefix(line, "# Finished Make data base on ") {
+			continue
+		}
+		if strings.HasPrefix(line, ".PHONY:") {
+			names := strings.Fields(strings.TrimPrefix(line, ".PHONY:"))
+			sort.Strings(names)
+			line = ".PHONY: " + strings.Join(names, " ")
+		}
+		lines = append(lines, line)
+	}
+	printed := strings.Join(lines, "\n")
+	// Each file is a paragraph of its own in the files section
+	start := strings.Index(printed, "\n# Files\n")
+	end := strings.Index(printed, "\n# VPATH Search Paths\n")
+	if start == -1 || end < start {
+		return printed, nil
+	}
+	var files []string
+	for _, file := range strings.Split(printed[start:end], "\n\n") {
+		// The blank lines between the files are not part of them
+		if file = strings.Trim(file, "\n"); file != "" {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	return printed[:start] + "\n" + strings.Join(files, "\n\n") + "\n" + printed[end:], nil
+}
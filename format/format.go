@@ -0,0 +1,286 @@
+// Package format formats parsed makefiles in a consistent style, without changing
+// what they mean.
+//
+// Only whitespace is changed, and the order of the names given to .PHONY, if asked for.
+// Lines are never joined or split, so that every line keeps its line number, and the
+// recipes, the bodies of "define" and the lines that could not be parsed are kept as they are.
+package format
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/xyproto/ake/parse"
+)
+
+// Options is how makefiles are formatted
+type Options struct {
+	Indent    int  // the number of spaces that lines within conditionals are indented by, per level
+	SortPhony bool // sort the names given to .PHONY
+}
+
+// DefaultOptions are the options that are used by "ake fmt" if no flags are given
+var DefaultOptions = Options{Indent: 2}
+
+// File returns the formatted text of the given makefile:
+//
+//   - Assignments have one space on each side of the operator, like "CC = gcc".
+//   - Lines within conditionals are indented by the given number of spaces per level,
+//     and other lines that are not recipe lines are not indented. Only the first physical
+//     line is indented, and the lines after a "\" keep the whitespace they start with.
+//   - The "\" at the end of continued lines are aligned, one space after the longest line,
+//     except in recipes, where the whitespace is passed on to the shell.
+//   - The names given to .PHONY are sorted, if SortPhony is set, while each line keeps
+//     the same number of names.
+func File(f *parse.File, options Options) string {
+	var sb strings.Builder
+	p := &printer{options: options, sb: &sb}
+	p.nodes(f.Nodes, 0)
+	return sb.String()
+}
+
+// printer writes formatted nodes
+type printer struct {
+	options Options
+	sb      *strings.Builder
+}
+
+// nodes writes the given nodes, where the given depth is how many conditionals they are within
+func (p *printer) nodes(nodes []parse.Node, depth int) {
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *parse.Conditional:
+			for _, branch := range n.Branches {
+				p.line(branch.Directive.Raw, depth)
+				p.nodes(branch.Nodes, depth+1)
+			}
+			if n.End != nil {
+				p.line(n.End.Raw, depth)
+			}
+		case *parse.Assignment:
+			raw := p.indent(n.Raw, depth)
+			if spaced, ok := spaceOperator(raw, n); ok {
+				raw = p.indent(spaced, depth)
+			}
+			p.sb.WriteString(alignContinuations(raw))
+		case *parse.Rule:
+			p.sb.WriteString(p.rule(n, depth))
+			for _, recipeNode := range n.Recipe {
+				p.sb.WriteString(recipeNode.Text())
+			}
+		case *parse.Define:
+			// The body is the value of the variable, and is kept as it is
+			p.sb.WriteString(p.indent(n.Raw, depth))
+			p.sb.WriteString(n.Body)
+			if n.End != nil {
+				p.sb.WriteString(p.indent(n.End.Raw, depth))
+			}
+		case *parse.Comment:
+			p.sb.WriteString(p.indent(n.Raw, depth))
+		case *parse.Directive, *parse.Expression:
+			p.line(node.Text(), depth)
+		default:
+			// Blank lines, recipe lines within conditionals and lines that could not be parsed
+			p.sb.WriteString(node.Text())
+		}
+	}
+}
+
+// line writes a line that is not a recipe line, indented by the given depth,
+// with the continuations aligned
+func (p *printer) line(raw string, depth int) {
+	p.sb.WriteString(alignContinuations(p.indent(raw, depth)))
+}
+
+// indent replaces the whitespace at the start of the first physical line of the given text
+// with the indentation for the given depth
+func (p *printer) indent(raw string, depth int) string {
+	trimmed := strings.TrimLeft(raw, " \t")
+	if trimmed == "" || strings.HasPrefix(trimmed, "\n") || strings.HasPrefix(trimmed, "\r") {
+		return raw
+	}
+	return strings.Repeat(" ", depth*p.options.Indent) + trimmed
+}
+
+// rule formats a rule line, without its recipe
+func (p *printer) rule(r *parse.Rule, depth int) string {
+	raw := p.indent(r.Raw, depth)
+	if r.Variable != nil {
+		// A target-specific variable, like "all: CFLAGS = -O2"
+		if pos := colonEnd(raw, r); pos != -1 {
+			if spaced, ok := spaceOperator(raw[pos:], r.Variable); ok {
+				raw = raw[:pos] + " " + spaced
+			}
+		}
+	} else if p.options.SortPhony && isPhonyList(r) {
+		if pos := colonEnd(raw, r); pos != -1 {
+			sorted := append([]string{}, r.Normal...)
+			sort.Strings(sorted)
+			raw = raw[:pos] + replaceWords(raw[pos:], sorted)
+		}
+	}
+	if r.Command != nil {
+		// Continuations in a recipe after ";" are passed on to the shell
+		return raw
+	}
+	return alignContinuations(raw)
+}
+
+// colonEnd returns the index right after the ":" or "::" of the given rule, in the first
+// physical line of the given text. Returns -1 if it is not on the first line.
+func colonEnd(raw string, r *parse.Rule) int {
+	first := raw
+	if pos := strings.Index(raw, "\n"); pos != -1 {
+		first = raw[:pos]
+	}
+	pos := parse.IndexOutsideReferences(first, ':')
+	if pos == -1 {
+		return -1
+	}
+	pos++
+	if r.DoubleColon {
+		if !strings.HasPrefix(first[pos:], ":") {
+			return -1
+		}
+		pos++
+	}
+	return pos
+}
+
+// isPhonyList checks if the given rule is a list of names given to .PHONY that can be sorted,
+// without references, comments or order-only prerequisites that could be moved around
+func isPhonyList(r *parse.Rule) bool {
+	return r.TargetText == ".PHONY" && !r.DoubleColon && r.Command == nil && len(r.OrderOnly) == 0 &&
+		!strings.ContainsAny(r.Raw, "$#|")
+}
+
+// replaceWords replaces the words in the given text with the given words, in order,
+// keeping the whitespace between them and the "\" at the end of each continued line
+func replaceWords(text string, words []string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		continued := i < len(lines)-1
+		body, end := line, ""
+		if strings.HasSuffix(body, "\r") {
+			body, end = body[:len(body)-1], "\r"
+		}
+		if continued && strings.HasSuffix(body, "\\") {
+			body, end = body[:len(body)-1], "\\"+end
+		}
+		var sb strings.Builder
+		inWord := false
+		for j := 0; j < len(body); j++ {
+			space := body[j] == ' ' || body[j] == '\t'
+			switch {
+			case space:
+				sb.WriteByte(body[j])
+			case !inWord && len(words) > 0:
+				sb.WriteString(words[0])
+				words = words[1:]
+			case !inWord:
+				// More words than expected, which should not happen
+				return text
+			}
+			inWord = !space
+		}
+		lines[i] = sb.String() + end
+	}
+	if len(words) > 0 {
+		return text
+	}
+	return strings.Join(lines, "\n")
+}
+
+// spaceOperator returns the given assignment, which starts at the start of the given text,
+// with one space on each side of the operator, as in "CC = gcc". Whitespace before the
+// assignment is removed. Returns false if the operator is not on the first physical line,
+// or if the text does not match the assignment.
+func spaceOperator(text string, a *parse.Assignment) (string, bool) {
+	rest := strings.TrimLeft(text, " \t")
+	var prefix strings.Builder
+	for {
+		word := ""
+		switch {
+		case a.Export && startsWithWord(rest, "export"):
+			word = "export"
+		case a.Override && startsWithWord(rest, "override"):
+			word = "override"
+		}
+		if word == "" {
+			break
+		}
+		prefix.WriteString(word + " ")
+		rest = strings.TrimLeft(rest[len(word):], " \t")
+	}
+	if !strings.HasPrefix(rest, a.Name) {
+		return text, false
+	}
+	rest = strings.TrimLeft(rest[len(a.Name):], " \t")
+	if !strings.HasPrefix(rest, a.Op) {
+		return text, false
+	}
+	rest = strings.TrimLeft(rest[len(a.Op):], " \t")
+	if rest == "" || strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r") {
+		return prefix.String() + a.Name + " " + a.Op + rest, true
+	}
+	return prefix.String() + a.Name + " " + a.Op + " " + rest, true
+}
+
+// startsWithWord checks if the given text starts with the given word, followed by whitespace
+func startsWithWord(text, word string) bool {
+	return strings.HasPrefix(text, word) && len(text) > len(word) && (text[len(word)] == ' ' || text[len(word)] == '\t')
+}
+
+// alignContinuations aligns the "\" at the end of each continued physical line in the given
+// text, one space after the longest of those lines. Outside of recipes, a "\" and newline
+// and the whitespace around it are the same as a single space, so this does not change
+// what the line means.
+func alignContinuations(raw string) string {
+	lines := strings.Split(raw, "\n")
+	last := len(lines) - 1
+	if lines[last] == "" {
+		// After the newline at the end of the last physical line
+		last--
+	}
+	if last < 1 {
+		return raw
+	}
+	type continued struct {
+		body, end string
+	}
+	parts := make([]continued, last)
+	column := 0
+	for i := 0; i < last; i++ {
+		line := lines[i]
+		end := ""
+		if strings.HasSuffix(line, "\r") {
+			line, end = line[:len(line)-1], "\r"
+		}
+		if !strings.HasSuffix(line, "\\") {
+			// Not a continued line, which should not happen
+			return raw
+		}
+		body := strings.TrimRight(line[:len(line)-1], " \t")
+		parts[i] = continued{body, end}
+		if w := width(body); w > column {
+			column = w
+		}
+	}
+	for i, part := range parts {
+		lines[i] = part.body + strings.Repeat(" ", column+1-width(part.body)) + "\\" + part.end
+	}
+	return strings.Join(lines, "\n")
+}
+
+// width returns how wide the given text is when it is shown, with tab stops every 8 columns
+func width(text string) int {
+	w := 0
+	for _, r := range text {
+		if r == '\t' {
+			w += 8 - w%8
+		} else {
+			w++
+		}
+	}
+	return w
+}
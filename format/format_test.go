@@ -0,0 +1,83 @@
+package format
+
+import (
+	"testing"
+
+	"github.com/xyproto/ake/parse"
+)
+
+// TestFile checks the formatted text of makefiles against the expected text
+func TestFile(t *testing.T) {
+	sorted := Options{Indent: 2, SortPhony: true}
+	for _, test := range []struct {
+		name    string
+		options Options
+		input   string
+		want    string
+	}{
+		{
+			"operator spacing", DefaultOptions,
+			"CC=gcc\nCFLAGS   +=  -O2\nexport  LD:=ld\noverride X?=1\nall: CFLAGS=-g\nEMPTY =\n",
+			"CC = gcc\nCFLAGS += -O2\nexport LD := ld\noverride X ?= 1\nall: CFLAGS = -g\nEMPTY =\n",
+		},
+		{
+			"backslash alignment", DefaultOptions,
+			"SRCS = a.c \\\n  bb.c \\\n\tccc.c\nall: a \\\n  b\n",
+			"SRCS = a.c \\\n  bb.c     \\\n\tccc.c\nall: a \\\n  b\n",
+		},
+		{
+			"recipes are kept", DefaultOptions,
+			"all:\n\techo a   \\\n\t  b\n\t@echo  c\n",
+			"all:\n\techo a   \\\n\t  b\n\t@echo  c\n",
+		},
+		{
+			"conditional indentation", DefaultOptions,
+			"ifdef A\nX = 1\nifeq ($(B),1)\n\tY = 2\nelse\n     Y = 3\nendif\nall: ; @echo\nendif\n",
+			"ifdef A\n  X = 1\n  ifeq ($(B),1)\n    Y = 2\n  else\n    Y = 3\n  endif\n  all: ; @echo\nendif\n",
+		},
+		{
+			"conditional indentation by 4", Options{Indent: 4},
+			"ifdef A\nX = 1\nendif\n",
+			"ifdef A\n    X = 1\nendif\n",
+		},
+		{
+			"continuation lines within conditionals", DefaultOptions,
+			"ifdef A\nSRCS = a.c \\\n b.c\nendif\n",
+			"ifdef A\n  SRCS = a.c \\\n b.c\nendif\n",
+		},
+		{
+			"phony names are not sorted by default", DefaultOptions,
+			".PHONY: zz aa \\\n  mm\n",
+			".PHONY: zz aa \\\n  mm\n",
+		},
+		{
+			"sort phony", sorted,
+			".PHONY: zz aa \\\n  mm\n.PHONY: $(X) b a\n.PHONY: c b | a\n",
+			".PHONY: aa mm \\\n  zz\n.PHONY: $(X) b a\n.PHONY: c b | a\n",
+		},
+		{
+			"CRLF", DefaultOptions,
+			"CC=gcc\r\nifdef A\r\nX=1\r\nendif\r\nSRCS = a.c \\\r\n  bb.c\r\nall:\r\n\techo hi\r\n",
+			"CC = gcc\r\nifdef A\r\n  X = 1\r\nendif\r\nSRCS = a.c \\\r\n  bb.c\r\nall:\r\n\techo hi\r\n",
+		},
+		{
+			"define bodies and comments", DefaultOptions,
+			"ifdef A\n# comment\ndefine BODY\n  kept  =  as is\nendef\nendif\n",
+			"ifdef A\n  # comment\n  define BODY\n  kept  =  as is\n  endef\nendif\n",
+		},
+	} {
+		f := parse.ParseString("Makefile", test.input)
+		if len(f.Diagnostics) > 0 {
+			t.Fatalf("%s: %v", test.name, f.Diagnostics)
+		}
+		got := File(f, test.options)
+		if got != test.want {
+			t.Errorf("%s: got\n%q\nwant\n%q", test.name, got, test.want)
+			continue
+		}
+		// Formatting is idempotent
+		if again := File(parse.ParseString("Makefile", got), test.options); again != got {
+			t.Errorf("%s: formatting again gives\n%q", test.name, again)
+		}
+	}
+}
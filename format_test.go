@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestSameMeaning checks that a makefile is only formatted if the database that is printed
+// with -p stays the same, apart from the order of the files and of the names given to .PHONY
+func TestSameMeaning(t *testing.T) {
+	for _, test := range []struct {
+		original, formatted string
+		same                bool
+	}{
+		{"CC=gcc\nall: b a\n\t@echo\n", "CC = gcc\nall: b a\n\t@echo\n", true},
+		{".PHONY: b a\na b:\n", ".PHONY: a b\na b:\n", true},
+		{"A = 1\n", "A = 2\n", false},
+		{"all: b a\n", "all: a b\n", false},
+		{"all:\n\techo  a\n", "all:\n\techo a\n", false},
+		{"A = 1\n", "A = $(error stop)\nB = $(A)\n", false},
+	} {
+		err := sameMeaning("Makefile", test.original, test.formatted)
+		if test.same && err != nil {
+			t.Errorf("%q and %q: %v", test.original, test.formatted, err)
+		}
+		if !test.same && (err == nil || !strings.Contains(err.Error(), "is not formatted")) {
+			t.Errorf("%q and %q: the error is %v", test.original, test.formatted, err)
+		}
+	}
+}
+
+// TestFormatArguments checks that "fmt" and "--fmt" are found after flags and their values
+func TestFormatArguments(t *testing.T) {
+	for _, test := range []struct {
+		args, flags, rest string
+		explicit, found   bool
+	}{
+		{"fmt -w", "", "-w", false, true},
+		{"--fmt -l Makefile", "", "-l Makefile", true, true},
+		{"-C dir --fmt", "-C dir", "", true, true},
+		{"-C dir fmt", "-C dir", "", false, true},
+		{"-Cdir -f mk fmt", "-Cdir -f mk", "", false, true},
+		{"-j fmt", "-j", "", false, true},
+		{"-j 4 fmt", "-j 4", "", false, true},
+		{"all fmt", "", "", false, false},
+		{"-- fmt", "", "", false, false},
+		{"-k", "", "", false, false},
+	} {
+		flags, rest, explicit, found := formatArguments(strings.Fields(test.args))
+		if strings.Join(flags, " ") != test.flags || strings.Join(rest, " ") != test.rest || explicit != test.explicit || found != test.found {
+			t.Errorf("%q: got %q, %q, %v and %v", test.args, flags, rest, explicit, found)
+		}
+	}
+}
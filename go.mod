@@ -1,5 +1,5 @@
 module github.com/xyproto/ake
 
-go 1.13
+go 1.16
 
 require github.com/xyproto/makeflags v1.1.1-0.20220421125523-d99461485e8a
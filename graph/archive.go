@@ -0,0 +1,60 @@
+package graph
+
+import "strings"
+
+// SplitMember splits an archive member reference, like "libfoo.a(bar.o)", into the archive,
+// "libfoo.a", and the member, "bar.o". Returns false if the name is not a reference to an
+// archive member, which needs a nonempty archive name and a nonempty member name.
+func SplitMember(name string) (archive, member string, ok bool) {
+	open := strings.Index(name, "(")
+	if open < 1 || !strings.HasSuffix(name, ")") || open+2 >= len(name) {
+		return "", "", false
+	}
+	return name[:open], name[open+1 : len(name)-1], true
+}
+
+// IsMember checks if the given name is a reference to an archive member, like "libfoo.a(bar.o)"
+func IsMember(name string) bool {
+	_, _, ok := SplitMember(name)
+	return ok
+}
+
+// SplitNames splits a list of targets or prerequisites at whitespace. A reference to several
+// members of an archive, like "libfoo.a(bar.o baz.o)", becomes one name per member, like
+// "libfoo.a(bar.o)" and "libfoo.a(baz.o)", as GNU Make does.
+func SplitNames(text string) []string {
+	var names []string
+	words := strings.Fields(text)
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		open := strings.Index(word, "(")
+		if open < 1 || strings.Contains(word, ")") {
+			names = append(names, word)
+			continue
+		}
+		// Collect the members until the closing parenthesis
+		archive := word[:open]
+		members := []string{word[open+1:]}
+		end := -1
+		for j := i + 1; j < len(words); j++ {
+			if close := strings.Index(words[j], ")"); close != -1 {
+				members = append(members, words[j][:close])
+				end = j
+				break
+			}
+			members = append(members, words[j])
+		}
+		if end == -1 {
+			// The parenthesis is not closed, so this is not an archive member reference
+			names = append(names, word)
+			continue
+		}
+		for _, member := range members {
+			if member != "" {
+				names = append(names, archive+"("+member+")")
+			}
+		}
+		i = end
+	}
+	return names
+}
@@ -0,0 +1,44 @@
+package graph
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestSplitNames checks that references to several archive members become one name per member
+func TestSplitNames(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		want []string
+	}{
+		{"a b", []string{"a", "b"}},
+		{"lib.a(a.o)", []string{"lib.a(a.o)"}},
+		{"lib.a(a.o b.o) c", []string{"lib.a(a.o)", "lib.a(b.o)", "c"}},
+		{"x lib.a( a.o  b.o )", []string{"x", "lib.a(a.o)", "lib.a(b.o)"}},
+		{"lib.a(a.o", []string{"lib.a(a.o"}},
+		{"(a.o b.o)", []string{"(a.o", "b.o)"}},
+	} {
+		if got := SplitNames(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+// TestSplitMember checks which names are references to archive members
+func TestSplitMember(t *testing.T) {
+	for _, test := range []struct {
+		name, archive, member string
+		ok                    bool
+	}{
+		{"lib.a(a.o)", "lib.a", "a.o", true},
+		{"dir/lib.a(sub/a.o)", "dir/lib.a", "sub/a.o", true},
+		{"lib.a()", "", "", false},
+		{"(a.o)", "", "", false},
+		{"lib.a", "", "", false},
+	} {
+		archive, member, ok := SplitMember(test.name)
+		if archive != test.archive || member != test.member || ok != test.ok {
+			t.Errorf("%q: got %q, %q and %v", test.name, archive, member, ok)
+		}
+	}
+}
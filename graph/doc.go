@@ -0,0 +1,3 @@
+// Package graph holds the targets of a makefile, with their prerequisites and recipes,
+// and the pattern rules that can be used for targets that have no explicit rule.
+package graph
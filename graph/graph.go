@@ -0,0 +1,235 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Graph is an indexed collection of all make targets, as discovered when evaluating
+// a makefile, together with the pattern rules.
+// Each Target is allocated on its own, so that pointers to targets, and their IDs,
+// stay valid when more targets are added. Targets may be added and looked up concurrently.
+type Graph struct {
+	mut          sync.RWMutex
+	targets      []*Target          // all targets, where the index is the target ID
+	byName       map[string]*Target // map from target name to target
+	PatternRules []*PatternRule     // all pattern rules, in the order they were defined
+}
+
+// Position is where something was defined in a makefile
+type Position struct {
+	File string // the makefile
+	Line int    // the line number, starting at 1
+}
+
+// Command is a recipe line, which is expanded right before it is run
+type Command struct {
+	Text string   // the command, with the "@", "-" and "+" prefixes, not expanded
+	Pos  Position // where the command was defined
+}
+
+// Recipe is the list of commands that are run to make a target
+type Recipe struct {
+	Commands []Command
+	Pos      Position // the position of the first command
+}
+
+// Rule is one of several double-colon rules for a target,
+// which each have their own prerequisites and recipe
+type Rule struct {
+	Normal    []*Target // Before "|"
+	OrderOnly []*Target // After "|"
+	Recipe    *Recipe   // The recipe, or nil
+	Deferred  *Deferred // Prerequisites that are expanded a second time, or nil
+	Pos       Position  // where the rule was defined
+}
+
+// Deferred is a list of prerequisites that is expanded a second time, after all makefiles have
+// been read, since the rule was defined after .SECONDEXPANSION and the prerequisites still
+// contain variable references after the first expansion. For pattern rules, this is done
+// for each target the rule is tried for.
+type Deferred struct {
+	Normal    string // the prerequisites before "|", after the first expansion
+	OrderOnly string // the prerequisites after "|", after the first expansion
+	Stem      string // the stem of a static pattern rule, as in $$*
+	Recipe    bool   // the rule has the recipe, so the prerequisites come first, as in $<
+}
+
+// Target represents a make target, like "all", "clean" or "main.o"
+type Target struct {
+	ID           int         // ID, a counter
+	Name         string      // Can be a regular name or it can be something like $(OBJDIR)/%.o
+	Normal       []*Target   // Before "|"
+	OrderOnly    []*Target   // After "|"
+	Phony        bool        // Is it .PHONY ?
+	Precious     bool        // Is it .PRECIOUS ?
+	Intermediate bool        // Is it .INTERMEDIATE ?
+	Secondary    bool        // Is it .SECONDARY ?
+	IsTarget     bool        // Is it the target of a rule, and not only a prerequisite?
+	DoubleColon  bool        // Are the rules for this target "::" rules?
+	Rules        []*Rule     // The "::" rules, if DoubleColon is true
+	Recipe       *Recipe     // Commands to run, or nil if there is no recipe
+	Deferred     []*Deferred // Prerequisites that are expanded a second time, after the makefiles are read
+	Pos          Position    // where the target was first given a rule
+	Status       *Status     // what happened when goals were made, or nil if the target was not considered
+
+	normalSet    map[*Target]struct{} // the targets in Normal, so that duplicates are found in constant time
+	orderOnlySet map[*Target]struct{} // the targets in OrderOnly
+}
+
+// Status is what happened to a target while goals were made,
+// as shown when the database is printed afterwards
+type Status struct {
+	Searched bool      // an implicit rule was searched for
+	Ran      bool      // a recipe was run, so the stem has been set
+	Stem     string    // the stem, as in $*
+	Exists   bool      // the file existed after the target was considered
+	MTime    time.Time // the modification time, if the file exists
+	Failed   bool      // the target could not be made
+	Question bool      // the target is out of date, but was not made since -q is set
+}
+
+// New creates a new and empty graph,
+// with room for the given number of targets before it needs to grow.
+func New(capacity int) *Graph {
+	return &Graph{
+		targets: make([]*Target, 0, capacity),
+		byName:  make(map[string]*Target, capacity),
+	}
+}
+
+// Len returns the number of targets
+func (g *Graph) Len() int {
+	g.mut.RLock()
+	defer g.mut.RUnlock()
+	return len(g.targets)
+}
+
+// Targets returns all targets, in the order they were added.
+// The returned slice must not be modified.
+func (g *Graph) Targets() []*Target {
+	g.mut.RLock()
+	defer g.mut.RUnlock()
+	return g.targets[:len(g.targets):len(g.targets)]
+}
+
+// HasName checks if the given name exists in the collection of targets
+func (g *Graph) HasName(name string) bool {
+	g.mut.RLock()
+	defer g.mut.RUnlock()
+	_, found := g.byName[name]
+	return found
+}
+
+// HasTarget checks if the given target has the same ID as one in the collection of targets
+func (g *Graph) HasTarget(target *Target) bool {
+	g.mut.RLock()
+	defer g.mut.RUnlock()
+	return target.ID >= 0 && target.ID < len(g.targets) && g.targets[target.ID] == target
+}
+
+// Lookup returns the Target with the given name, or nil if there is none
+func (g *Graph) Lookup(name string) *Target {
+	g.mut.RLock()
+	defer g.mut.RUnlock()
+	return g.byName[name]
+}
+
+// GetTarget returns a pointer to the Target with the given name
+func (g *Graph) GetTarget(name string) (*Target, error) {
+	if t := g.Lookup(name); t != nil {
+		return t, nil
+	}
+	return nil, errors.New("could not find " + name)
+}
+
+// GetTargetByID returns a pointer to the Target with the given ID
+func (g *Graph) GetTargetByID(id int) (*Target, error) {
+	g.mut.RLock()
+	defer g.mut.RUnlock()
+	if id < 0 || id >= len(g.targets) {
+		return nil, fmt.Errorf("could not find target with ID %d", id)
+	}
+	return g.targets[id], nil
+}
+
+// AddTarget creates a new Target struct with the given name
+// and returns a pointer to it, that can be used for modifying the target later.
+// If a target with the given name already exists, that one is returned instead.
+func (g *Graph) AddTarget(name string) *Target {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if t, found := g.byName[name]; found {
+		return t
+	}
+	t := &Target{}
+	t.ID = len(g.targets)
+	t.Name = name
+	g.targets = append(g.targets, t)
+	g.byName[name] = t
+	return t
+}
+
+// AddNormal adds the given target as a normal prerequisite, unless it is already there
+func (t *Target) AddNormal(prerequisite *Target) {
+	t.Normal = addUnique(t.Normal, &t.normalSet, prerequisite)
+}
+
+// AddOrderOnly adds the given target as an order-only prerequisite, unless it is already there
+func (t *Target) AddOrderOnly(prerequisite *Target) {
+	t.OrderOnly = addUnique(t.OrderOnly, &t.orderOnlySet, prerequisite)
+}
+
+// PrependNormal adds the given targets as the first normal prerequisites.
+// This is used for the prerequisites of the rule with the recipe, so that
+// they come first in $^ and the first of them is $<.
+func (t *Target) PrependNormal(prerequisites []*Target) {
+	var normal []*Target
+	set := make(map[*Target]struct{}, len(prerequisites)+len(t.Normal))
+	for _, p := range prerequisites {
+		normal = addUnique(normal, &set, p)
+	}
+	for _, p := range t.Normal {
+		normal = addUnique(normal, &set, p)
+	}
+	t.Normal, t.normalSet = normal, set
+}
+
+// addUnique appends the given target to the given targets, unless it is in the given set of
+// the same targets already, and returns the result. The set is made again if the targets
+// were changed without it, as when Normal is set directly.
+func addUnique(targets []*Target, set *map[*Target]struct{}, target *Target) []*Target {
+	if *set == nil || len(*set) != len(targets) {
+		*set = make(map[*Target]struct{}, len(targets)+1)
+		for _, t := range targets {
+			(*set)[t] = struct{}{}
+		}
+	}
+	if _, found := (*set)[target]; found {
+		return targets
+	}
+	(*set)[target] = struct{}{}
+	return append(targets, target)
+}
+
+// String returns the name of the target, which is also what %v prints for a *Target.
+// This avoids printing the entire graph of prerequisites.
+func (t *Target) String() string {
+	return t.Name
+}
+
+// String returns the names of all targets
+func (g *Graph) String() string {
+	return fmt.Sprintf("%v", g.Targets())
+}
+
+// Names returns the names of the given targets
+func Names(targets []*Target) []string {
+	names := make([]string, len(targets))
+	for i, t := range targets {
+		names[i] = t.Name
+	}
+	return names
+}
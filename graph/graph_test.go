@@ -0,0 +1,67 @@
+package graph
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestStablePointers checks that targets keep their pointers and IDs when many more
+// targets are added, so that the graph can grow while targets are being used
+func TestStablePointers(t *testing.T) {
+	g := New(4)
+	const first, more = 100, 20000
+	kept := make([]*Target, first)
+	for i := range kept {
+		kept[i] = g.AddTarget("first" + strconv.Itoa(i))
+		if kept[i].ID != i {
+			t.Fatalf("target %d has ID %d", i, kept[i].ID)
+		}
+	}
+	for i := 0; i < more; i++ {
+		t := g.AddTarget("more" + strconv.Itoa(i))
+		t.AddNormal(kept[i%first])
+	}
+	if g.Len() != first+more {
+		t.Fatalf("expected %d targets, got %d", first+more, g.Len())
+	}
+	for i, target := range kept {
+		name := "first" + strconv.Itoa(i)
+		if found := g.Lookup(name); found != target {
+			t.Fatalf("Lookup(%q) returns a different target after more targets were added", name)
+		}
+		if found, err := g.GetTargetByID(i); err != nil || found != target {
+			t.Fatalf("GetTargetByID(%d) returns a different target after more targets were added", i)
+		}
+		if target.ID != i || target.Name != name {
+			t.Fatalf("target %d changed to %d %q", i, target.ID, target.Name)
+		}
+		if again := g.AddTarget(name); again != target {
+			t.Fatalf("AddTarget(%q) returns a new target for an existing name", name)
+		}
+	}
+}
+
+// TestAddNormalDuplicates checks that prerequisites are only added once, also after
+// Normal has been changed directly, and after prerequisites have been prepended
+func TestAddNormalDuplicates(t *testing.T) {
+	g := New(4)
+	target, a, b, c := g.AddTarget("all"), g.AddTarget("a"), g.AddTarget("b"), g.AddTarget("c")
+	for _, p := range []*Target{a, b, a, c, b} {
+		target.AddNormal(p)
+	}
+	if got := Names(target.Normal); strings.Join(got, " ") != "a b c" {
+		t.Fatalf("the prerequisites are %v", got)
+	}
+	target.PrependNormal([]*Target{c, c})
+	target.AddNormal(a)
+	if got := Names(target.Normal); strings.Join(got, " ") != "c a b" {
+		t.Fatalf("the prerequisites are %v after prepending", got)
+	}
+	target.Normal = nil
+	target.AddNormal(b)
+	target.AddNormal(b)
+	if got := Names(target.Normal); strings.Join(got, " ") != "b" {
+		t.Fatalf("the prerequisites are %v after they were removed", got)
+	}
+}
@@ -0,0 +1,278 @@
+package graph
+
+import (
+	"sort"
+	"strings"
+)
+
+// maxChainLength is how many implicit rules that may be chained together,
+// like making foo from foo.o, and foo.o from foo.c
+const maxChainLength = 8
+
+// PatternRule is an implicit rule, like "%.o: %.c", where "%" matches any nonempty stem
+type PatternRule struct {
+	Targets   []string  // target patterns, each with one "%"
+	Normal    []string  // prerequisite patterns, before "|"
+	OrderOnly []string  // prerequisite patterns, after "|"
+	Recipe    *Recipe   // the recipe, or nil if the rule cancels an implicit rule
+	Deferred  *Deferred // the prerequisites, if they are expanded a second time for each target
+	Terminal  bool      // "::" instead of ":", the prerequisites must exist
+	Builtin   bool      // a built-in rule, not from a makefile
+	Pos       Position  // where the rule was defined
+}
+
+// Match is a pattern rule that has been found for a target, together with the stem
+// and the prerequisites the rule has for that target
+type Match struct {
+	Rule         *PatternRule
+	Stem         string          // what "%" matched, with any directory prepended, as in $*
+	Normal       []string        // the prerequisites, with the stem substituted
+	OrderOnly    []string        // the order-only prerequisites, with the stem substituted
+	Intermediate map[string]bool // prerequisites that do not exist, but can be made by chaining rules
+}
+
+// MatchPattern checks if the given pattern, like "%.o", matches the given name, like "main.o".
+// Returns the stem, which is "main" in this case.
+func MatchPattern(pattern, name string) (string, bool) {
+	pos := strings.Index(pattern, "%")
+	if pos == -1 {
+		return "", pattern == name
+	}
+	prefix, suffix := pattern[:pos], pattern[pos+1:]
+	if len(name) < len(prefix)+len(suffix)+1 || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
+
+// Substitute replaces the first "%" in the given pattern with the given stem
+func Substitute(pattern, stem string) string {
+	return strings.Replace(pattern, "%", stem, 1)
+}
+
+// IsPattern checks if the given name contains a "%"
+func IsPattern(name string) bool {
+	return strings.Contains(name, "%")
+}
+
+// IsMatchAnything checks if the rule has a target pattern that is just "%"
+func (r *PatternRule) IsMatchAnything() bool {
+	for _, t := range r.Targets {
+		if t == "%" {
+			return true
+		}
+	}
+	return false
+}
+
+// match checks if any of the target patterns of the rule matches the given name.
+// If a pattern has no "/", only the file name part is matched, and the directory
+// is prepended to the prerequisites afterwards, as GNU Make does.
+// Returns the stem without the directory, and the directory.
+func (r *PatternRule) match(name string) (string, string, bool) {
+	for _, pattern := range r.Targets {
+		if strings.Contains(pattern, "/") {
+			if stem, ok := MatchPattern(pattern, name); ok {
+				return stem, "", true
+			}
+			continue
+		}
+		dir, base := "", name
+		if pos := strings.LastIndex(name, "/"); pos != -1 {
+			dir, base = name[:pos+1], name[pos+1:]
+		}
+		if stem, ok := MatchPattern(pattern, base); ok {
+			return stem, dir, true
+		}
+	}
+	return "", "", false
+}
+
+// substituteAll substitutes the stem in all the given prerequisite patterns.
+// Prerequisites without a "%" are used as they are.
+func substituteAll(patterns []string, stem, dir string) []string {
+	result := make([]string, len(patterns))
+	for i, p := range patterns {
+		if IsPattern(p) {
+			result[i] = dir + Substitute(p, stem)
+		} else {
+			result[i] = p
+		}
+	}
+	return result
+}
+
+// candidate is a pattern rule that matches a target
+type candidate struct {
+	rule      *PatternRule
+	stem, dir string
+	normal    []string // the prerequisites, once they are known
+	orderOnly []string // the order-only prerequisites, once they are known
+	expanded  bool     // the prerequisites are known
+}
+
+// FindRule searches for a pattern rule with a recipe that can make the target with the given name.
+// The exists function should check if a file exists. Files that are mentioned in the makefile
+// "ought to exist", and are also accepted as prerequisites. If no rule has prerequisites that
+// exist, rules are chained, so that missing prerequisites can be made by other pattern rules.
+// For an archive member, like "lib.a(main.o)", rules for the member alone are searched next,
+// with target patterns like "(%)", where the stem is the member name, "main.o".
+// Returns nil if no rule is found.
+func (g *Graph) FindRule(name string, exists func(string) bool) *Match {
+	return g.FindRuleWith(name, Search{Exists: exists})
+}
+
+// SearchLog is given each step of the search for an implicit rule, with how deep the search
+// is in a chain of rules, which is 0 for the target itself
+type SearchLog func(depth int, format string, args ...interface{})
+
+// Expander expands the deferred prerequisites of a pattern rule for the target with the given
+// name, where the given stem is what "%" matched, with any directory prepended
+type Expander func(d *Deferred, target, stem string) (normal, orderOnly []string)
+
+// Search is how an implicit rule is searched for, by FindRuleWith
+type Search struct {
+	Exists func(string) bool // checks if a file exists
+	Expand Expander          // expands deferred prerequisites, or nil if rules with them are not used
+	Log    SearchLog         // is given each step of the search, in the format of GNU Make's "--debug=i", if set
+}
+
+// logf gives a step of the search at the given depth to the log function, if there is one
+func (s *Search) logf(depth int, format string, args ...interface{}) {
+	if s.Log != nil {
+		s.Log(depth, format, args...)
+	}
+}
+
+// prerequisites returns the prerequisites of a rule that matches the target with the given name.
+// Deferred prerequisites are only expanded once for each candidate.
+func (s *Search) prerequisites(c *candidate, name string) (normal, orderOnly []string) {
+	if c.expanded {
+		return c.normal, c.orderOnly
+	}
+	if c.rule.Deferred != nil {
+		c.normal, c.orderOnly = s.Expand(c.rule.Deferred, name, c.dir+c.stem)
+	} else {
+		c.normal, c.orderOnly = substituteAll(c.rule.Normal, c.stem, c.dir), substituteAll(c.rule.OrderOnly, c.stem, c.dir)
+	}
+	c.expanded = true
+	return c.normal, c.orderOnly
+}
+
+// FindRuleWith is the same as FindRule, but files are checked, deferred prerequisites are
+// expanded and the steps of the search are logged as given
+func (g *Graph) FindRuleWith(name string, s Search) *Match {
+	s.logf(0, "Looking for an implicit rule for '%s'.", name)
+	if m := g.findRule(name, name, &s, 0, nil); m != nil {
+		return m
+	}
+	if _, member, ok := SplitMember(name); ok {
+		s.logf(0, "Looking for archive-member implicit rule for '%s'.", name)
+		if m := g.findRule(name, "("+member+")", &s, 0, nil); m != nil {
+			return m
+		}
+	}
+	s.logf(0, "No implicit rule found for '%s'.", name)
+	return nil
+}
+
+// findRule searches for a rule for the target with the given name, where the target patterns
+// of the rules are matched against the given text, which is the name itself except for
+// archive members. The depth is how long the chain of rules is, and the rules that are
+// already used in the chain are not used again.
+func (g *Graph) findRule(name, text string, s *Search, depth int, used map[*PatternRule]bool) *Match {
+	if depth > maxChainLength {
+		return nil
+	}
+	logf := func(format string, args ...interface{}) {
+		s.logf(depth, format, args...)
+	}
+	var candidates []candidate
+	onlyMatchAnything := true
+	for _, rule := range g.PatternRules {
+		if used[rule] {
+			continue
+		}
+		if stem, dir, ok := rule.match(text); ok {
+			candidates = append(candidates, candidate{rule: rule, stem: stem, dir: dir})
+			if !rule.IsMatchAnything() {
+				onlyMatchAnything = false
+			}
+		}
+	}
+	// Rules with shorter stems are more specific, and are tried first
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len(candidates[i].stem) < len(candidates[j].stem)
+	})
+	var usable []*candidate
+	for i := range candidates {
+		c := &candidates[i]
+		if c.rule.Recipe == nil {
+			// Cancelled implicit rule
+			continue
+		}
+		if c.rule.Deferred != nil && s.Expand == nil {
+			continue
+		}
+		if !onlyMatchAnything && c.rule.IsMatchAnything() && !c.rule.Terminal {
+			continue
+		}
+		if depth > 0 && c.rule.IsMatchAnything() && !c.rule.Terminal {
+			// Non-terminal match-anything rules are not used for intermediate files
+			continue
+		}
+		usable = append(usable, c)
+	}
+	oughtToExist := func(prerequisite string) bool {
+		return s.Exists(prerequisite) || g.HasName(prerequisite)
+	}
+	// First, look for a rule where all prerequisites exist or ought to exist
+	for _, c := range usable {
+		logf("Trying pattern rule with stem '%s'.", c.stem)
+		normal, orderOnly := s.prerequisites(c, name)
+		found := true
+		for _, p := range append(normal[:len(normal):len(normal)], orderOnly...) {
+			logf("Trying implicit prerequisite '%s'.", p)
+			if !oughtToExist(p) {
+				found = false
+				break
+			}
+		}
+		if found {
+			logf("Found an implicit rule for '%s'.", name)
+			return &Match{c.rule, c.dir + c.stem, normal, orderOnly, nil}
+		}
+	}
+	// Then, try to chain rules, to make the missing prerequisites
+	for _, c := range usable {
+		if c.rule.Terminal {
+			continue
+		}
+		logf("Trying pattern rule with stem '%s'.", c.stem)
+		normal, orderOnly := s.prerequisites(c, name)
+		intermediate := make(map[string]bool)
+		found := true
+		for _, p := range append(normal[:len(normal):len(normal)], orderOnly...) {
+			if oughtToExist(p) {
+				continue
+			}
+			logf("Looking for a rule with intermediate file '%s'.", p)
+			chainUsed := map[*PatternRule]bool{c.rule: true}
+			for r := range used {
+				chainUsed[r] = true
+			}
+			s.logf(depth+1, "Looking for an implicit rule for '%s'.", p)
+			if g.findRule(p, p, s, depth+1, chainUsed) == nil {
+				s.logf(depth+1, "No implicit rule found for '%s'.", p)
+				found = false
+				break
+			}
+			intermediate[p] = true
+		}
+		if found {
+			logf("Found an implicit rule for '%s'.", name)
+			return &Match{c.rule, c.dir + c.stem, normal, orderOnly, intermediate}
+		}
+	}
+	return nil
+}
@@ -2,31 +2,242 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"strconv"
 
+	"github.com/xyproto/ake/eval"
+	"github.com/xyproto/ake/exec"
 	"github.com/xyproto/makeflags"
 )
 
+// defaultJobs is the number of jobs makeflags gives when -j is not used
+const defaultJobs = 99
+
+// unlimitedJobs is the number of jobs for -j without a number, which allows any number of jobs at once
+const unlimitedJobs = 1 << 20
+
+// session is a single run of ake, from reading the makefiles until exiting
+type session struct {
+	db        *eval.Database
+	jobserver *exec.Jobserver // the shared job slots, when running jobs in parallel or as a sub-make
+	owner     bool            // the jobserver was created by this make, not by a parent make
+	dir       string          // the directory that was entered, if "Entering directory" was printed
+	database  bool            // print the database before exiting, as with -p
+	args      []string        // the arguments that make was started with, for restarting
+	start     string          // the directory make was started in, for restarting
+}
+
 func main() {
+	if args, ok := formatMode(os.Args[1:]); ok {
+		os.Exit(formatMakefiles(args))
+	}
+	s := &session{args: os.Args}
+	s.start, _ = os.Getwd()
+	// The flags of a parent make are given in $MAKEFLAGS, and come before the flags of this make
+	inherited, inheritedVariables := parseMakeFlags(os.Getenv("MAKEFLAGS"))
+	// --jobserver-style is not known by makeflags, and neither is -j without a number
+	style, own := removeFlag(os.Args[1:], "jobserver-style")
+	inheritedUnlimited, inherited := removeUnlimitedJobs(inherited)
+	ownUnlimited, own := removeUnlimitedJobs(own)
+	own = reorderArguments(own)
+	os.Args = append(append([]string{os.Args[0]}, inherited...), own...)
 	config := makeflags.New()
+	args := os.Args[1:]
 
 	if config.VersionInfoAndExit {
 		fmt.Println(makeflags.Version)
 		os.Exit(0)
 	}
 
-	if len(config.Targets) == 0 && config.Makefile == "" {
-		fmt.Println("make: *** No targets specified and no makefile found.  Stop.")
-		os.Exit(2)
+	// Several -C flags are applied one after the other, so that "-C a -C b" is the same as "-C a/b"
+	directories := flagValues(args, "C", "directory")
+	for _, dir := range directories {
+		if err := os.Chdir(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: *** %s: No such file or directory.  Stop.\n", program(), dir)
+			os.Exit(2)
+		}
+	}
+
+	s.database = config.PrintInternalDB
+	// The directory is printed with -w, and by default for sub-makes and when -C is given
+	printDirectory := config.PrintDirectory || (!config.Silent && (len(directories) > 0 || level() > 0))
+	if containsString(args, "--no-print-directory") || containsString(args, "-no-print-directory") {
+		printDirectory = false
+	}
+	config.PrintDirectory = printDirectory
+	if printDirectory {
+		if wd, err := os.Getwd(); err == nil {
+			s.dir = wd
+			// After a restart, the directory has already been entered
+			if restarts() == 0 {
+				s.log("%s: Entering directory '%s'", program(), wd)
+			}
+		}
+	}
+
+	jobs := config.Jobs
+	if jobs == defaultJobs {
+		jobs = 1
+	}
+	// Sub-makes share the job slots of the top-level make, unless they are given -j themselves
+	auth := jobserverAuth(os.Getenv("MAKEFLAGS"))
+	ownJobs := len(flagValues(own, "j", "jobs")) > 0 || ownUnlimited
+	if ownUnlimited || (inheritedUnlimited && !ownJobs) {
+		jobs = unlimitedJobs
+	}
+	if auth != "" && !ownJobs {
+		js, err := exec.OpenJobserver(auth)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: warning: jobserver unavailable: using -j1.  Add '+' to parent make rule.\n", program())
+			jobs = 1
+		}
+		s.jobserver = js
+	} else if jobs == unlimitedJobs {
+		// There are no job slots to share, and sub-makes get -j without a number as well
+		if auth != "" {
+			fmt.Fprintf(os.Stderr, "%s: warning: -j0 forced in submake: resetting jobserver mode.\n", program())
+		}
+	} else if jobs > 1 {
+		if auth != "" {
+			fmt.Fprintf(os.Stderr, "%s: warning: -j%d forced in submake: resetting jobserver mode.\n", program(), jobs)
+		}
+		js, err := exec.NewJobserver(jobs, style == "fifo")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: warning: could not create a jobserver: %s\n", program(), err)
+		}
+		s.jobserver, s.owner = js, err == nil
+	}
+	config.Jobs = jobs
+	auth = ""
+	if s.jobserver != nil {
+		auth = s.jobserver.Auth()
 	}
 
-	fmt.Printf("[%s] %v\n", config.Makefile, config.Targets)
+	debug := exec.Debug{}
+	if config.DebugInfo {
+		debug, _ = exec.ParseDebug("a")
+	}
+	if config.DebugFlags != "" {
+		flags, err := exec.ParseDebug(config.DebugFlags)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: *** %s.  Stop.\n", program(), err)
+			s.exit(2)
+		}
+		debug = flags
+	}
+	if debug.Basic {
+		fmt.Printf("ake, compatible with GNU Make %s\n", eval.Version)
+		fmt.Println("Reading makefiles...")
+	}
 
-	state, err := Parse(config.Makefile)
+	goals, variables := splitArguments(config.Targets)
+	variables = append(inheritedVariables, variables...)
+	command, err := os.Executable()
 	if err != nil {
-		log.Fatalln(err)
+		command = os.Args[0]
+	}
+	options := eval.Options{
+		Environment:        os.Environ(),
+		EnvironmentFirst:   config.EnvironmentOverride,
+		Variables:          variables,
+		MakeFlags:          makeFlags(config, args, variables, auth),
+		Command:            command,
+		Goals:              goals,
+		Eval:               flagValues(args, "eval"),
+		NoBuiltinRules:     config.NoBuiltinRules,
+		NoBuiltinVariables: config.NoBuiltinVars,
+		AllowMissing:       true,
+		Verbose:            debug.Verbose,
+		WarnUndefined:      config.WarnUndefined,
+	}
+	// Several -I flags are searched in order, and are all passed on to sub-makes
+	options.IncludeDirs = flagValues(args, "I", "include-dir")
+	// The makefiles are found again, since makeflags looks for them before changing directory
+	makefiles := flagValues(args, "f", "file", "makefile")
+	db, err := eval.Load(options, makefiles...)
+	s.db = db
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		s.exit(2)
+	}
+	if len(db.Makefiles) == 0 && len(goals) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: *** No targets specified and no makefile found.  Stop.\n", program())
+		s.exit(2)
 	}
 
-	fmt.Println(state)
+	execOptions := exec.Options{
+		Jobs:         jobs,
+		Silent:       config.Silent,
+		DryRun:       config.DryRun,
+		Question:     config.StatusOnly,
+		Touch:        config.TouchTargets,
+		Always:       config.AlwaysMake,
+		Symlinks:     config.CheckSymlinkTime,
+		KeepGoing:    config.KeepGoing,
+		IgnoreErrors: config.IgnoreErrors,
+		OldFiles:     flagValues(args, "o", "old-file", "assume-old"),
+		NewFiles:     flagValues(args, "W", "what-if", "new-file", "assume-new"),
+		Jobserver:    s.jobserver,
+		Trace:        config.PrintTrace,
+		Debug:        debug,
+		Interrupt:    s.notifySignals(),
+	}
+	if debug.Basic {
+		fmt.Println("Updating makefiles....")
+	}
+	remakeFailed := s.remakeMakefiles(config, execOptions, goals)
+	if debug.Basic {
+		fmt.Println("Updating goal targets....")
+	}
+	err = exec.Run(db, execOptions, goals...)
+	if interrupted, ok := err.(*exec.InterruptedError); ok {
+		s.interrupted(interrupted.Signal)
+	}
+	if err == exec.ErrOutOfDate {
+		s.exit(1)
+	} else if err != nil || remakeFailed {
+		s.exit(2)
+	}
+	s.exit(0)
+}
+
+// level returns how deeply nested this make is, from $MAKELEVEL, which is 0 for the top-level make
+func level() int {
+	n, err := strconv.Atoi(os.Getenv("MAKELEVEL"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// program returns the name that messages are prefixed with, like "make" or "make[1]" for a sub-make
+func program() string {
+	if n := level(); n > 0 {
+		return fmt.Sprintf("make[%d]", n)
+	}
+	return "make"
+}
+
+// log prints a message about the working directory to stdout.
+// When the database is printed, the message is a comment.
+func (s *session) log(format string, args ...interface{}) {
+	if s.database {
+		fmt.Print("# ")
+	}
+	fmt.Printf(format+"\n", args...)
+}
+
+// exit prints the database if -p was given, after the goals have been made,
+// prints "Leaving directory" if "Entering directory" was printed, then exits
+func (s *session) exit(code int) {
+	if s.jobserver != nil {
+		s.jobserver.Close()
+	}
+	if s.database && s.db != nil {
+		s.db.Print(os.Stdout)
+	}
+	if s.dir != "" {
+		s.log("%s: Leaving directory '%s'", program(), s.dir)
+	}
+	os.Exit(code)
 }
@@ -0,0 +1,102 @@
+package parse
+
+import "strings"
+
+// Assignment is a variable assignment in a Makefile, like "CC = gcc"
+type Assignment struct {
+	Source
+	Name     string // the variable name
+	Op       string // "=", ":=", "::=", "?=", "+=" or "!="
+	Value    string // the value, with leading whitespace and any "# comment" removed
+	Export   bool   // the "export" prefix
+	Override bool   // the "override" prefix
+}
+
+// assignmentOperators are the assignment operators that are recognized,
+// longest first, so that "::=" is found before ":=" and "=".
+var assignmentOperators = []string{"::=", ":=", "?=", "+=", "!=", "="}
+
+// NewAssignment interprets a line in a Makefile as a variable assignment.
+// Returns nil if the line is not a variable assignment.
+// The line may be indented, since an indented line outside of a rule can be an assignment.
+func NewAssignment(line string) *Assignment {
+	// Whitespace at the end is part of the value, as in GNU Make
+	trimmed := strings.TrimLeft(line, " \t")
+	if strings.TrimSpace(trimmed) == "" || strings.HasPrefix(trimmed, "#") {
+		return nil
+	}
+	a := &Assignment{}
+	for {
+		fields := strings.Fields(trimmed)
+		if len(fields) < 2 {
+			break
+		}
+		if fields[0] == "export" && !a.Export {
+			a.Export = true
+		} else if fields[0] == "override" && !a.Override {
+			a.Override = true
+		} else {
+			break
+		}
+		trimmed = strings.TrimLeft(trimmed[len(fields[0]):], " \t")
+	}
+	// Find the first "=", then check which operator it belongs to
+	pos := IndexOutsideReferences(trimmed, '=')
+	if pos < 1 {
+		return nil
+	}
+	// A ":" before the "=" that is not part of the operator means that this is a rule,
+	// like "all: CFLAGS=-O2" or "main.o: main.c"
+	for _, op := range assignmentOperators {
+		start := pos + 1 - len(op)
+		if start < 0 || trimmed[start:pos+1] != op {
+			continue
+		}
+		name := strings.TrimSpace(trimmed[:start])
+		if name == "" || IndexOutsideReferences(name, ':') != -1 || IndexOutsideReferences(name, '#') != -1 || strings.ContainsAny(name, " \t") {
+			return nil
+		}
+		a.Name = name
+		a.Op = op
+		a.Value = stripValueComment(strings.TrimLeft(trimmed[pos+1:], " \t"))
+		return a
+	}
+	return nil
+}
+
+// stripValueComment removes a trailing "# comment" from the value of an assignment,
+// keeping the whitespace before it, as GNU Make does. A "#" within a variable reference,
+// like "$(subst #,x,$(A))", does not start a comment, and "\#" is a "#" in the value.
+func stripValueComment(value string) string {
+	if !strings.Contains(value, "#") {
+		return value
+	}
+	var sb strings.Builder
+	depth := 0
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '\\' && i+1 < len(value) && value[i+1] == '#':
+			sb.WriteByte('#')
+			i++
+			continue
+		case c == '$' && i+1 < len(value) && (value[i+1] == '(' || value[i+1] == '{'):
+			depth++
+			sb.WriteString(value[i : i+2])
+			i++
+			continue
+		case c == '$' && i+1 < len(value):
+			// For example "$$" or "$@"
+			sb.WriteString(value[i : i+2])
+			i++
+			continue
+		case depth > 0 && (c == '(' || c == '{'):
+			depth++
+		case depth > 0 && (c == ')' || c == '}'):
+			depth--
+		case depth == 0 && c == '#':
+			return sb.String()
+		}
+		sb.WriteByte(value[i])
+	}
+	return sb.String()
+}
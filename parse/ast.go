@@ -0,0 +1,167 @@
+package parse
+
+import (
+	"io"
+	"strings"
+)
+
+// Node is a part of a makefile, like a rule, a variable assignment or a comment.
+// All nodes keep their original text, so that a makefile can be printed back
+// exactly as it was, after it has been parsed.
+type Node interface {
+	// Pos returns the line number where the node starts, starting at 1
+	Pos() int
+	// Text returns the original text of the node, including the trailing newline,
+	// line continuations and the text of all nodes within it
+	Text() string
+}
+
+// Source is the original text of a node, and the line number where it starts
+type Source struct {
+	Raw  string // the original text, including line continuations and the trailing newline
+	Line int    // the line number where the text starts, starting at 1
+}
+
+// Pos returns the line number where the node starts
+func (s *Source) Pos() int {
+	return s.Line
+}
+
+// Text returns the original text
+func (s *Source) Text() string {
+	return s.Raw
+}
+
+// Blank is an empty line, or a line with only whitespace
+type Blank struct {
+	Source
+}
+
+// Comment is a line starting with "#", possibly indented
+type Comment struct {
+	Source
+}
+
+// Directive is a line starting with a directive, like "include foo.mk",
+// "export CC", "vpath %.c src" or the "ifeq", "else" and "endif" lines of a Conditional
+type Directive struct {
+	Source
+	Name string // the directive, like "include", "-include" or "ifeq"
+	Args string // the rest of the line, with line continuations joined
+}
+
+// Branch is one branch of a Conditional, like the lines between "ifdef" and "else"
+type Branch struct {
+	Directive *Directive // the "ifeq", "ifneq", "ifdef", "ifndef" or "else" line
+	Nodes     []Node     // the nodes in this branch
+}
+
+// Conditional is a block starting with "ifeq", "ifneq", "ifdef" or "ifndef"
+// and ending with "endif", with one or more branches
+type Conditional struct {
+	Branches []*Branch  // the first branch and any "else" branches
+	End      *Directive // the "endif" line, or nil if it is missing
+}
+
+// Pos returns the line number of the first line of the conditional
+func (c *Conditional) Pos() int {
+	return c.Branches[0].Directive.Line
+}
+
+// Text returns the original text of the conditional and all its branches
+func (c *Conditional) Text() string {
+	var sb strings.Builder
+	for _, branch := range c.Branches {
+		sb.WriteString(branch.Directive.Raw)
+		for _, node := range branch.Nodes {
+			sb.WriteString(node.Text())
+		}
+	}
+	if c.End != nil {
+		sb.WriteString(c.End.Raw)
+	}
+	return sb.String()
+}
+
+// Define is a multi-line variable definition, from "define" to "endef"
+type Define struct {
+	Source              // the "define" line
+	Name     string     // the variable name
+	Op       string     // the assignment operator, "=" if none is given
+	Export   bool       // the "export" prefix
+	Override bool       // the "override" prefix
+	Body     string     // the original text of the lines between "define" and "endef"
+	End      *Directive // the "endef" line, or nil if it is missing
+}
+
+// Value returns the value of the defined variable, which is the body without the last newline
+func (d *Define) Value() string {
+	return strings.TrimSuffix(strings.TrimSuffix(d.Body, "\n"), "\r")
+}
+
+// Text returns the original text of the definition, from "define" to "endef"
+func (d *Define) Text() string {
+	if d.End == nil {
+		return d.Raw + d.Body
+	}
+	return d.Raw + d.Body + d.End.Raw
+}
+
+// Expression is a line that can only be interpreted after variables and functions in it
+// have been expanded, like "$(eval $(call template,foo))" or "$(RULES)"
+type Expression struct {
+	Source
+	Expr string // the line, with line continuations joined
+}
+
+// Invalid is a line that could not be parsed
+type Invalid struct {
+	Source
+	Message string // why the line could not be parsed, like "missing separator"
+}
+
+// File is a parsed makefile
+type File struct {
+	Path        string      // the path to the makefile, as given
+	Lines       int         // the number of physical lines
+	Nodes       []Node      // the top level nodes
+	Diagnostics Diagnostics // syntax errors found when parsing
+}
+
+// Text returns the original text of the entire makefile
+func (f *File) Text() string {
+	var sb strings.Builder
+	for _, node := range f.Nodes {
+		sb.WriteString(node.Text())
+	}
+	return sb.String()
+}
+
+// Print writes the makefile to the given io.Writer, byte for byte as it was parsed
+func (f *File) Print(w io.Writer) error {
+	_, err := io.WriteString(w, f.Text())
+	return err
+}
+
+// Walk calls the given function for each of the given nodes, in order, and then
+// for the nodes within them: the recipe of a Rule and the branches of a Conditional.
+// If the function returns false, the nodes within that node are skipped.
+func Walk(nodes []Node, f func(Node) bool) {
+	for _, node := range nodes {
+		if !f(node) {
+			continue
+		}
+		switch n := node.(type) {
+		case *Rule:
+			Walk(n.Recipe, f)
+		case *Conditional:
+			for _, branch := range n.Branches {
+				f(branch.Directive)
+				Walk(branch.Nodes, f)
+			}
+			if n.End != nil {
+				f(n.End)
+			}
+		}
+	}
+}
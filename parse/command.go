@@ -0,0 +1,20 @@
+package parse
+
+import "strings"
+
+// Command is a recipe line, indented with "\t", belonging to a rule.
+// The "@", "-" and "+" prefixes are kept, since they can also come from
+// expanding variables, and are interpreted when the command is run.
+type Command struct {
+	Source
+	Cmd string // the command, without the leading "\t", with line continuations kept
+}
+
+// NewCommand interprets a line that starts with "\t" in a Makefile,
+// or the recipe after ";" on a rule line, and returns a new Command struct.
+func NewCommand(line string) *Command {
+	if strings.HasPrefix(line, "\t") {
+		return &Command{Cmd: line[1:]}
+	}
+	return &Command{Cmd: strings.TrimLeft(line, " \t")}
+}
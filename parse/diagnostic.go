@@ -0,0 +1,87 @@
+package parse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity is how serious a Diagnostic is
+type Severity int
+
+const (
+	// Warning is for issues that are reported, but where parsing can continue
+	Warning Severity = iota
+	// Fatal is for issues that makes make stop
+	Fatal
+)
+
+// Diagnostic is an issue that was found when parsing a makefile,
+// together with the position where it was found.
+type Diagnostic struct {
+	File     string   // the makefile, or "" if the issue is not tied to a file
+	Line     int      // line number, starting at 1, or 0 if not tied to a line
+	Column   int      // column number, starting at 1, or 0 if not tied to a column
+	Severity Severity // Warning or Fatal
+	Message  string   // the message, without position, "***" or "Stop."
+}
+
+// Diagnostics is a collection of issues found when parsing a makefile.
+// It can be returned as an error, and the individual issues can then
+// be inspected by type asserting the error to Diagnostics.
+type Diagnostics []*Diagnostic
+
+// Position returns the "Makefile:12" prefix of the diagnostic, or "make" if there is no file
+func (d *Diagnostic) Position() string {
+	if d.File == "" {
+		return "make"
+	}
+	if d.Line == 0 {
+		return d.File
+	}
+	return fmt.Sprintf("%s:%d", d.File, d.Line)
+}
+
+// Error returns the diagnostic formatted the same way as GNU Make does,
+// like "Makefile:3: *** recipe commences before first target.  Stop."
+// or "Makefile:7: warning: overriding recipe for target 'all'"
+func (d *Diagnostic) Error() string {
+	if d.Severity == Warning {
+		return fmt.Sprintf("%s: warning: %s", d.Position(), d.Message)
+	}
+	return fmt.Sprintf("%s: *** %s.  Stop.", d.Position(), d.Message)
+}
+
+// Add appends a new diagnostic to the collection
+func (diagnostics *Diagnostics) Add(file string, line, column int, severity Severity, format string, args ...interface{}) {
+	*diagnostics = append(*diagnostics, &Diagnostic{file, line, column, severity, fmt.Sprintf(format, args...)})
+}
+
+// HasFatal checks if any of the diagnostics are fatal
+func (diagnostics Diagnostics) HasFatal() bool {
+	for _, d := range diagnostics {
+		if d.Severity == Fatal {
+			return true
+		}
+	}
+	return false
+}
+
+// Warnings returns only the diagnostics that are warnings
+func (diagnostics Diagnostics) Warnings() Diagnostics {
+	var warnings Diagnostics
+	for _, d := range diagnostics {
+		if d.Severity == Warning {
+			warnings = append(warnings, d)
+		}
+	}
+	return warnings
+}
+
+// Error returns all the diagnostics, one per line
+func (diagnostics Diagnostics) Error() string {
+	lines := make([]string, len(diagnostics))
+	for i, d := range diagnostics {
+		lines[i] = d.Error()
+	}
+	return strings.Join(lines, "\n")
+}
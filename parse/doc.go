@@ -0,0 +1,6 @@
+// Package parse turns makefiles into a tree of nodes, without evaluating them.
+//
+// Each node keeps its original text, so that a parsed makefile can be printed
+// back byte for byte, or be modified by tools before it is printed.
+// Variables, functions and conditionals are left for package eval.
+package parse
@@ -0,0 +1,439 @@
+package parse
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Line is what has been learned about a single logical line of a makefile,
+// by looking at that line alone. A logical line is one or more physical lines,
+// joined by a trailing "\".
+type Line struct {
+	Assignment *Assignment // set if the line is a variable assignment
+	Rule       *Rule       // set if the line is a rule, like "main.o: main.c"
+	Command    *Command    // set if the line is indented with "\t"
+	Directive  bool        // set if the line starts with a directive, like "include"
+}
+
+// WorkerFunc is a type of function that can be used to concurrently parse a single line.
+// It takes a line index, the line contents and a pointer to the Line where the results should be stored.
+// A WorkerFunc must only look at the given line and only write to the given Line, which belongs
+// to that line alone. This way, the results do not depend on the order the lines are parsed in.
+type WorkerFunc func(int, string, *Line)
+
+// ForEachLine will call a collection of functions concurrently, per line,
+// then wait for all the concurrent functions to finish after all lines has been
+// iterated over. The lines are divided into one chunk per CPU, so that the
+// number of goroutines does not grow with the size of the makefile.
+// Returns one Line per given line.
+func ForEachLine(lines []string, functionCollection []WorkerFunc) []Line {
+	parsed := make([]Line, len(lines))
+	chunkSize := len(lines)/runtime.NumCPU() + 1
+	var wg sync.WaitGroup
+	for start := 0; start < len(lines); start += chunkSize {
+		end := start + chunkSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for lineIndex := start; lineIndex < end; lineIndex++ {
+				// For each line, call all functions in the functionCollection
+				for _, f := range functionCollection {
+					f(lineIndex, lines[lineIndex], &parsed[lineIndex])
+				}
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return parsed
+}
+
+// logicalLine is one or more physical lines, where all but the last one end with "\"
+type logicalLine struct {
+	raw  string // the original text, including the trailing newline
+	text string // the original text, without the trailing newline
+	line int    // the line number of the first physical line
+}
+
+// splitLines splits the contents of a makefile into logical lines.
+// Also returns the number of physical lines.
+func splitLines(contents string) ([]logicalLine, int) {
+	var (
+		logicalLines []logicalLine
+		current      logicalLine
+		lineNumber   int
+	)
+	for _, physical := range strings.SplitAfter(contents, "\n") {
+		if physical == "" {
+			// After the last newline
+			break
+		}
+		lineNumber++
+		if current.raw == "" {
+			current.line = lineNumber
+		}
+		current.raw += physical
+		if continues(physical) {
+			continue
+		}
+		current.text = strings.TrimSuffix(strings.TrimSuffix(current.raw, "\n"), "\r")
+		logicalLines = append(logicalLines, current)
+		current = logicalLine{}
+	}
+	if current.raw != "" {
+		// The file ends with a "\"
+		current.text = current.raw
+		logicalLines = append(logicalLines, current)
+	}
+	return logicalLines, lineNumber
+}
+
+// continues checks if the given physical line ends with an odd number of "\",
+// which means that it continues on the next line
+func continues(physical string) bool {
+	physical = strings.TrimSuffix(strings.TrimSuffix(physical, "\n"), "\r")
+	count := 0
+	for i := len(physical) - 1; i >= 0 && physical[i] == '\\'; i-- {
+		count++
+	}
+	return count%2 == 1
+}
+
+// joinContinuations joins a logical line that is not a recipe into a single line.
+// Each "\" + newline, and the whitespace around it, is replaced by a single space.
+func joinContinuations(text string) string {
+	if !strings.Contains(text, "\n") {
+		return text
+	}
+	physicalLines := strings.Split(text, "\n")
+	for i, physical := range physicalLines {
+		physical = strings.TrimSuffix(physical, "\r")
+		if i < len(physicalLines)-1 {
+			physical = strings.TrimRight(strings.TrimSuffix(physical, "\\"), " \t")
+		}
+		if i > 0 {
+			physical = strings.TrimLeft(physical, " \t")
+		}
+		physicalLines[i] = physical
+	}
+	return strings.Join(physicalLines, " ")
+}
+
+// recipeText returns a logical recipe line as the shell should see it.
+// The "\" + newline are kept, but a leading tab on each continued line is removed.
+func recipeText(text string) string {
+	if !strings.Contains(text, "\n") {
+		return text
+	}
+	physicalLines := strings.Split(text, "\n")
+	for i := 1; i < len(physicalLines); i++ {
+		physicalLines[i] = strings.TrimPrefix(physicalLines[i], "\t")
+	}
+	return strings.Join(physicalLines, "\n")
+}
+
+// directiveName returns the directive that the given line starts with, after any
+// "export" or "override" prefixes for "define", together with the rest of the line.
+// Returns an empty name if the line does not start with a directive.
+func directiveName(line string) (string, string) {
+	if !isDirective(line) {
+		return "", ""
+	}
+	trimmed := strings.TrimSpace(line)
+	end := strings.IndexAny(trimmed, " \t(")
+	if end == -1 {
+		end = len(trimmed)
+	}
+	return trimmed[:end], strings.TrimSpace(trimmed[end:])
+}
+
+// conditionalDirectives are the directives that start a Conditional
+var conditionalDirectives = map[string]bool{"ifeq": true, "ifneq": true, "ifdef": true, "ifndef": true}
+
+// builder builds the tree of nodes from the parsed logical lines
+type builder struct {
+	file         *File
+	containers   []*[]Node      // the stack of node slices that nodes are added to
+	conditionals []*Conditional // the stack of conditionals that are not yet ended
+	rule         *Rule          // the current rule, that recipe lines belong to
+	ruleNodes    *[]Node        // the node slice that the current rule was added to
+	pending      []Node         // blank lines and comments after the last recipe line
+}
+
+// add adds a node to the current node slice
+func (b *builder) add(node Node) {
+	b.flush()
+	container := b.containers[len(b.containers)-1]
+	*container = append(*container, node)
+}
+
+// flush adds pending blank lines and comments to the current node slice
+func (b *builder) flush() {
+	container := b.containers[len(b.containers)-1]
+	*container = append(*container, b.pending...)
+	b.pending = nil
+}
+
+// addRecipeLine adds a recipe line to the current rule, or to the current node slice,
+// if the recipe line is within or after a conditional that started after the rule,
+// so that the nodes stay in the order of the lines
+func (b *builder) addRecipeLine(command *Command) {
+	container := b.containers[len(b.containers)-1]
+	if container != b.ruleNodes || len(*container) == 0 || (*container)[len(*container)-1] != Node(b.rule) {
+		b.add(command)
+		return
+	}
+	b.rule.Recipe = append(b.rule.Recipe, b.pending...)
+	b.rule.Recipe = append(b.rule.Recipe, command)
+	b.pending = nil
+}
+
+// addBlankOrComment adds a blank line or a comment. Within a recipe, they are held back
+// until it is known if they are followed by more recipe lines.
+func (b *builder) addBlankOrComment(node Node) {
+	if b.rule != nil && b.containers[len(b.containers)-1] == b.ruleNodes {
+		b.pending = append(b.pending, node)
+		return
+	}
+	b.add(node)
+}
+
+// Parse reads a makefile from the given io.Reader and parses it into a File.
+// The given name is used in diagnostics, like "Makefile:3: *** missing separator.  Stop."
+// An error is only returned if the makefile could not be read. Syntax errors are
+// found in the Diagnostics field of the returned File.
+func Parse(name string, r io.Reader) (*File, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseString(name, string(contents)), nil
+}
+
+// ParseFS reads the makefile with the given name from the given file system
+// and parses it into a File.
+func ParseFS(fsys fs.FS, name string) (*File, error) {
+	contents, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseString(name, string(contents)), nil
+}
+
+// ParseString parses the contents of a makefile into a File, with a tree of nodes.
+// The lines are parsed concurrently, then the tree is built in line order.
+func ParseString(path string, contents string) *File {
+	logicalLines, lineCount := splitLines(contents)
+
+	texts := make([]string, len(logicalLines))
+	for i, l := range logicalLines {
+		texts[i] = l.text
+	}
+
+	functionCollection := []WorkerFunc{
+		// Variable assignment handler
+		func(lineIndex int, line string, parsed *Line) {
+			parsed.Assignment = NewAssignment(joinContinuations(line))
+		},
+		// Rule handler
+		func(lineIndex int, line string, parsed *Line) {
+			parsed.Rule = NewRule(joinContinuations(line))
+		},
+		// Command handler
+		func(lineIndex int, line string, parsed *Line) {
+			if strings.HasPrefix(line, "\t") {
+				parsed.Command = NewCommand(recipeText(line))
+			}
+		},
+		// Directive handler
+		func(lineIndex int, line string, parsed *Line) {
+			parsed.Directive = isDirective(joinContinuations(line))
+		},
+	}
+
+	// Perform concurrent parsing of the makefile
+	parsedLines := ForEachLine(texts, functionCollection)
+
+	// Build the tree of nodes, in line order
+	file := &File{Path: path, Lines: lineCount}
+	b := &builder{file: file, containers: []*[]Node{&file.Nodes}}
+	for i := 0; i < len(logicalLines); i++ {
+		l := logicalLines[i]
+		parsed := parsedLines[i]
+		source := Source{l.raw, l.line}
+		joined := joinContinuations(l.text)
+		trimmed := strings.TrimSpace(joined)
+		switch {
+		case parsed.Command != nil && b.rule != nil:
+			// A recipe line
+			if trimmed == "" {
+				b.addBlankOrComment(&Blank{source})
+				continue
+			}
+			parsed.Command.Source = source
+			b.addRecipeLine(parsed.Command)
+		case trimmed == "":
+			b.addBlankOrComment(&Blank{source})
+		case strings.HasPrefix(trimmed, "#"):
+			b.addBlankOrComment(&Comment{source})
+		case parsed.Assignment != nil:
+			parsed.Assignment.Source = source
+			b.add(parsed.Assignment)
+			// A variable assignment ends the recipe of the current rule
+			b.rule = nil
+		case parsed.Directive:
+			i = b.directive(logicalLines, i, source, joined)
+		case parsed.Command != nil:
+			// Outside of a rule, an indented line that is not an assignment or a directive
+			b.invalid(source, "recipe commences before first target")
+		case parsed.Rule != nil:
+			parsed.Rule.Source = source
+			b.add(parsed.Rule)
+			b.rule = parsed.Rule
+			b.ruleNodes = b.containers[len(b.containers)-1]
+			if parsed.Rule.Variable != nil {
+				// A target-specific variable has no recipe
+				b.rule = nil
+			}
+		case strings.Contains(joined, "$"):
+			b.add(&Expression{source, trimmed})
+			b.rule = nil
+		default:
+			b.invalid(source, "missing separator")
+		}
+	}
+	b.flush()
+	if len(b.conditionals) > 0 {
+		// At the end of the makefile, so there is no column
+		file.Diagnostics.Add(path, lineCount+1, 0, Fatal, "missing 'endif'")
+	}
+	return file
+}
+
+// invalid adds an Invalid node, and a diagnostic with the same message
+func (b *builder) invalid(source Source, message string) {
+	b.add(&Invalid{source, message})
+	b.file.Diagnostics.Add(b.file.Path, source.Line, column(source.Raw), Fatal, "%s", message)
+}
+
+// column returns the column of the first character in the given line that is not
+// whitespace, starting at 1, or 0 if there is none
+func column(line string) int {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ', '\t':
+			continue
+		case '\n', '\r':
+			return 0
+		}
+		return i + 1
+	}
+	return 0
+}
+
+// directive adds a directive node for the logical line at the given index.
+// For "define", the lines up to "endef" are also consumed.
+// Returns the index of the last logical line that was consumed.
+func (b *builder) directive(logicalLines []logicalLine, i int, source Source, joined string) int {
+	name, args := directiveName(joined)
+	directive := &Directive{source, name, args}
+	switch {
+	case conditionalDirectives[name]:
+		b.flush()
+		c := &Conditional{Branches: []*Branch{{Directive: directive}}}
+		b.add(c)
+		b.conditionals = append(b.conditionals, c)
+		b.containers = append(b.containers, &c.Branches[0].Nodes)
+	case name == "else":
+		if len(b.conditionals) == 0 {
+			b.invalid(source, "extraneous 'else'")
+			return i
+		}
+		b.flush()
+		c := b.conditionals[len(b.conditionals)-1]
+		branch := &Branch{Directive: directive}
+		c.Branches = append(c.Branches, branch)
+		b.containers[len(b.containers)-1] = &branch.Nodes
+	case name == "endif":
+		if len(b.conditionals) == 0 {
+			b.invalid(source, "extraneous 'endif'")
+			return i
+		}
+		b.flush()
+		b.conditionals[len(b.conditionals)-1].End = directive
+		b.conditionals = b.conditionals[:len(b.conditionals)-1]
+		b.containers = b.containers[:len(b.containers)-1]
+	case name == "define" || name == "export" || name == "override":
+		if d := newDefine(source, joined); d != nil {
+			b.add(d)
+			b.rule = nil
+			return b.defineBody(d, logicalLines, i)
+		}
+		b.add(directive)
+		b.rule = nil
+	case name == "endef":
+		b.invalid(source, "extraneous 'endef'")
+	default:
+		// include, export, unexport, vpath and the other directives end the current recipe
+		b.add(directive)
+		b.rule = nil
+	}
+	return i
+}
+
+// newDefine interprets a line like "override define NAME :=" as the start of a Define.
+// Returns nil if the line does not start a Define.
+func newDefine(source Source, line string) *Define {
+	d := &Define{Source: source, Op: "="}
+	fields := strings.Fields(line)
+	for len(fields) > 0 && (fields[0] == "export" || fields[0] == "override") {
+		d.Export = d.Export || fields[0] == "export"
+		d.Override = d.Override || fields[0] == "override"
+		fields = fields[1:]
+	}
+	if len(fields) < 2 || fields[0] != "define" {
+		return nil
+	}
+	d.Name = fields[1]
+	if len(fields) > 2 {
+		d.Op = fields[2]
+	}
+	for _, op := range assignmentOperators {
+		if strings.HasSuffix(d.Name, op) && len(d.Name) > len(op) {
+			d.Name, d.Op = d.Name[:len(d.Name)-len(op)], op
+			break
+		}
+	}
+	return d
+}
+
+// defineBody reads the body of a Define, up to the matching "endef".
+// Returns the index of the "endef" line, or of the last line if there is no "endef".
+func (b *builder) defineBody(d *Define, logicalLines []logicalLine, i int) int {
+	var body strings.Builder
+	depth := 1
+	for i++; i < len(logicalLines); i++ {
+		l := logicalLines[i]
+		name, _ := directiveName(l.text)
+		if newDefine(Source{}, l.text) != nil {
+			depth++
+		} else if name == "endef" {
+			depth--
+			if depth == 0 {
+				d.Body = body.String()
+				d.End = &Directive{Source{l.raw, l.line}, name, ""}
+				return i
+			}
+		}
+		body.WriteString(l.raw)
+	}
+	d.Body = body.String()
+	b.file.Diagnostics.Add(b.file.Path, d.Line, column(d.Raw), Fatal, "missing 'endef', unterminated 'define'")
+	return i
+}
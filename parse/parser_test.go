@@ -0,0 +1,124 @@
+package parse
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stressMakefile has rules with recipes, conditionals, a define and continued lines,
+// so that every kind of node is built
+const stressMakefile = `# A makefile for the stress test
+CC = gcc
+CFLAGS := -O2 \
+	-Wall # warnings
+SOURCES = main.c util.c
+OBJECTS = $(SOURCES:.c=.o)
+
+.PHONY: all clean
+
+all: main
+
+main: $(OBJECTS) | build
+	$(CC) -o $@ $^
+
+	@echo linked
+
+%.o: %.c
+	$(CC) $(CFLAGS) -c -o $@ $<
+
+ifeq ($(DEBUG),1)
+CFLAGS += -g
+ifdef VERBOSE
+  Q =
+else
+  Q = @
+endif
+else ifneq ($(RELEASE),)
+CFLAGS += -DNDEBUG
+else
+CFLAGS += -O0
+endif
+
+define COMPILE
+$(CC) $(CFLAGS) \
+	-c $1
+endef
+
+clean: ; rm -f main $(OBJECTS)
+build:
+ifdef VERBOSE
+	@echo making $@
+endif
+	mkdir -p $@
+$(eval $(call COMPILE,extra.c))
+`
+
+// TestParseConcurrently parses the same makefile many times, in parallel, and checks
+// that the lines are always put together in the same way
+func TestParseConcurrently(t *testing.T) {
+	const count = 2000
+	// Each parse uses one goroutine per CPU, so the lines are parsed in parallel even with one CPU
+	makefile := strings.Repeat(stressMakefile, 4)
+	first := ParseString("Makefile", makefile)
+	if first.Text() != makefile {
+		t.Fatalf("the parsed makefile does not print back as it was:\n%s", first.Text())
+	}
+	if len(first.Diagnostics) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", first.Diagnostics)
+	}
+	files := make([]*File, count)
+	var wg sync.WaitGroup
+	workers := 2 * runtime.NumCPU()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < count; i += workers {
+				files[i] = ParseString("Makefile", makefile)
+			}
+		}(w)
+	}
+	wg.Wait()
+	for i, f := range files {
+		if f.Text() != first.Text() {
+			t.Fatalf("parse %d gives a different text", i)
+		}
+		if !reflect.DeepEqual(f.Nodes, first.Nodes) {
+			t.Fatalf("parse %d gives different nodes", i)
+		}
+		if !reflect.DeepEqual(f.Diagnostics, first.Diagnostics) {
+			t.Fatalf("parse %d gives different diagnostics: %v", i, f.Diagnostics)
+		}
+	}
+}
+
+// TestDiagnosticColumns checks that diagnostics point at the first character of the offending line
+func TestDiagnosticColumns(t *testing.T) {
+	tests := []struct {
+		makefile string
+		line     int
+		column   int
+		message  string
+	}{
+		{"all:\n  nonsense\n", 2, 3, "missing separator"},
+		{"x = 1\n\t\techo\n", 2, 3, "recipe commences before first target"},
+		{"  else\n", 1, 3, "extraneous 'else'"},
+		{"endif\n", 1, 1, "extraneous 'endif'"},
+		{"x = 1\n   define FOO\nbar\n", 2, 4, "missing 'endef', unterminated 'define'"},
+		{"ifdef X\nx = 1\n", 3, 0, "missing 'endif'"},
+	}
+	for _, test := range tests {
+		f := ParseString("Makefile", test.makefile)
+		if len(f.Diagnostics) != 1 {
+			t.Errorf("%q: expected one diagnostic, got %v", test.makefile, f.Diagnostics)
+			continue
+		}
+		d := f.Diagnostics[0]
+		if d.Line != test.line || d.Column != test.column || d.Message != test.message {
+			t.Errorf("%q: expected %d:%d %q, got %d:%d %q", test.makefile, test.line, test.column, test.message, d.Line, d.Column, d.Message)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package parse
+
+import "strings"
+
+// Rule is a line in a Makefile that introduces one or more targets,
+// like "main.o: main.c | objdir"
+type Rule struct {
+	Source
+	Targets     []string    // the target names, before the ":"
+	Normal      []string    // normal prerequisites, before "|"
+	OrderOnly   []string    // order-only prerequisites, after "|"
+	TargetText  string      // the text before the ":", which is expanded before it is split into targets
+	PrereqText  string      // the text after the ":" or "::", without any inline recipe or comment
+	DoubleColon bool        // "::" instead of ":"
+	Command     *Command    // a recipe given on the same line, after ";"
+	Variable    *Assignment // set for target-specific variables, like "all: CFLAGS = -O2"
+	Recipe      []Node      // the recipe lines below the rule, and any blank lines or comments between them
+}
+
+// Text returns the original text of the rule, including the recipe lines below it
+func (r *Rule) Text() string {
+	if len(r.Recipe) == 0 {
+		return r.Raw
+	}
+	var sb strings.Builder
+	sb.WriteString(r.Raw)
+	for _, node := range r.Recipe {
+		sb.WriteString(node.Text())
+	}
+	return sb.String()
+}
+
+// NewRule interprets a line in a Makefile as a rule.
+// Returns nil if the line is not a rule.
+func NewRule(line string) *Rule {
+	if strings.HasPrefix(line, "\t") || isDirective(line) || NewAssignment(line) != nil {
+		return nil
+	}
+	// Split off an inline recipe, like in "all: ; @echo hi"
+	var command *Command
+	line = stripComment(line)
+	if pos := IndexOutsideReferences(line, ';'); pos != -1 {
+		command = NewCommand(line[pos+1:])
+		line = line[:pos]
+	}
+	pos := IndexOutsideReferences(line, ':')
+	if pos == -1 {
+		return nil
+	}
+	r := &Rule{Command: command, TargetText: strings.TrimSpace(line[:pos])}
+	r.Targets = strings.Fields(line[:pos])
+	if len(r.Targets) == 0 {
+		return nil
+	}
+	rest := line[pos+1:]
+	if strings.HasPrefix(rest, ":") {
+		r.DoubleColon = true
+		rest = rest[1:]
+	}
+	r.PrereqText = strings.TrimSpace(rest)
+	// A target-specific variable, like "all: CFLAGS = -O2"
+	if a := NewAssignment(rest); a != nil {
+		r.Variable = a
+		return r
+	}
+	if pos := IndexOutsideReferences(rest, '|'); pos != -1 {
+		r.OrderOnly = strings.Fields(rest[pos+1:])
+		rest = rest[:pos]
+	}
+	r.Normal = strings.Fields(rest)
+	return r
+}
+
+// stripComment removes a trailing "# comment" from a line that is not a recipe.
+// Anything after a ";" is an inline recipe, and is left as it is.
+// A "#" within a variable reference, like "$(subst #,x,$(A))", does not start a comment.
+func stripComment(line string) string {
+	depth := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '$':
+			if i+1 < len(line) && (line[i+1] == '(' || line[i+1] == '{') {
+				depth++
+				i++
+			}
+		case ')', '}':
+			if depth > 0 {
+				depth--
+			}
+		case ';':
+			if depth == 0 {
+				return line
+			}
+		case '#':
+			if depth == 0 {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// IndexOutsideReferences returns the index of the first occurrence of the given character
+// that is not within a variable reference or function call, like "$(A:.c=.o)".
+// Returns -1 if it is not found.
+func IndexOutsideReferences(s string, c byte) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && (s[i+1] == '(' || s[i+1] == '{'):
+			depth++
+			i++
+		case s[i] == '$' && i+1 < len(s):
+			// For example "$$" or "$@"
+			i++
+		case depth > 0 && (s[i] == '(' || s[i] == '{'):
+			depth++
+		case depth > 0 && (s[i] == ')' || s[i] == '}'):
+			depth--
+		case depth == 0 && s[i] == c:
+			return i
+		}
+	}
+	return -1
+}
+
+// directives are the keywords that start a line that is neither a rule nor an assignment
+var directives = map[string]bool{
+	"define": true, "endef": true,
+	"ifdef": true, "ifndef": true, "ifeq": true, "ifneq": true, "else": true, "endif": true,
+	"include": true, "-include": true, "sinclude": true,
+	"export": true, "unexport": true, "override": true, "undefine": true, "vpath": true,
+}
+
+// isDirective checks if the given line starts with a directive, like "ifeq" or "include"
+func isDirective(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	word := fields[0]
+	if pos := strings.IndexAny(word, "(:"); pos != -1 {
+		// For example "ifeq(a,b)"
+		word = word[:pos]
+	}
+	return directives[word]
+}
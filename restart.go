@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/xyproto/ake/exec"
+	"github.com/xyproto/makeflags"
+)
+
+// maxRestarts is how many times make restarts itself after remaking makefiles, before
+// giving up, since a makefile that changes every time it is made would restart forever
+const maxRestarts = 20
+
+// restarts returns how many times make has restarted itself, from $MAKE_RESTARTS
+func restarts() int {
+	n, err := strconv.Atoi(os.Getenv("MAKE_RESTARTS"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// remakeMakefiles makes the makefiles that were read, and the included makefiles that were not
+// found, before the goals are made. If any of them changed, make restarts, to read them again.
+// With -n, -q and -t, the makefiles are still made, unless they are goals themselves.
+// Returns true if a makefile could not be made and -k is given, in which case the goals are
+// made anyway. Otherwise, make exits.
+func (s *session) remakeMakefiles(config *makeflags.Config, options exec.Options, goals []string) bool {
+	basic := options.Debug.Basic
+	options.DryRun, options.Question, options.Touch = false, false, false
+	if restarts() > 0 {
+		// With -B, the makefiles are only remade before the first restart
+		options.Always = false
+	}
+	if !options.Debug.Makefiles {
+		options.Debug.Basic, options.Debug.Verbose, options.Debug.Implicit = false, false, false
+	}
+	var makefiles, optional []string
+	for _, name := range s.db.MakefileNames() {
+		if (config.DryRun || config.StatusOnly || config.TouchTargets) && containsString(goals, name) {
+			continue
+		}
+		makefiles = append(makefiles, name)
+	}
+	for _, m := range s.db.Missing {
+		if m.Optional {
+			optional = append(optional, m.Name)
+		}
+	}
+	changed, err := exec.New(s.db, options).Remake(makefiles, optional)
+	if interrupted, ok := err.(*exec.InterruptedError); ok {
+		s.interrupted(interrupted.Signal)
+	}
+	failed := err != nil
+	for _, m := range s.db.Missing {
+		if _, statErr := os.Stat(m.Name); m.Optional || statErr == nil {
+			continue
+		}
+		failed = true
+		missing := s.db.ReportMissing(m)
+		if err != nil {
+			// The recipe of the makefile failed, which has already been reported
+			continue
+		}
+		if !config.KeepGoing {
+			fmt.Fprintln(os.Stderr, missing)
+			s.exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "%s: *** No rule to make target '%s'.\n", program(), m.Name)
+		fmt.Fprintf(os.Stderr, "%s: Failed to remake makefile '%s'.\n", program(), m.Name)
+	}
+	if failed && !config.KeepGoing {
+		s.exit(2)
+	}
+	if len(changed) > 0 && !failed {
+		s.restart(basic)
+	}
+	return failed
+}
+
+// restart runs make again, with the arguments and in the directory it was started with,
+// and with $MAKE_RESTARTS increased by one. With verbose set, the command is printed first,
+// as with --debug=b. Does not return.
+func (s *session) restart(verbose bool) {
+	n := restarts() + 1
+	if n > maxRestarts {
+		fmt.Fprintf(os.Stderr, "%s: *** Makefiles were remade %d times in a row.  Stop.\n", program(), maxRestarts)
+		s.exit(2)
+	}
+	if verbose {
+		fmt.Printf("Re-executing[%d]: %s\n", n, strings.Join(s.args, " "))
+	}
+	if s.jobserver != nil && s.owner {
+		// The restarted make creates a jobserver of its own
+		s.jobserver.Close()
+	}
+	env := []string{"MAKE_RESTARTS=" + strconv.Itoa(n)}
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "MAKE_RESTARTS=") {
+			env = append(env, v)
+		}
+	}
+	if err := os.Chdir(s.start); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: *** %s.  Stop.\n", program(), err)
+		os.Exit(2)
+	}
+	command, err := os.Executable()
+	if err != nil {
+		command = s.args[0]
+	}
+	err = reexec(command, s.args, env)
+	fmt.Fprintf(os.Stderr, "%s: *** %s: %s.  Stop.\n", program(), command, err)
+	os.Exit(2)
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestRestarts checks how many restarts are read from $MAKE_RESTARTS
+func TestRestarts(t *testing.T) {
+	defer os.Setenv("MAKE_RESTARTS", os.Getenv("MAKE_RESTARTS"))
+	for value, want := range map[string]int{"": 0, "1": 1, "20": 20, "-1": 0, "x": 0} {
+		os.Setenv("MAKE_RESTARTS", value)
+		if got := restarts(); got != want {
+			t.Errorf("%q: got %d restarts, want %d", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// reexec replaces the running make with the given command. Only returns if that fails.
+func reexec(command string, args, env []string) error {
+	return syscall.Exec(command, args, env)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// reexec runs the given command and exits with its exit status, since a process
+// can not replace itself on Windows. Only returns if the command could not be started.
+func reexec(command string, args, env []string) error {
+	cmd := exec.Command(command, args[1:]...)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+)
+
+// notifySignals returns a channel where the signals that stop make are received, like
+// SIGINT and SIGTERM, so that the running commands can be killed and the targets they
+// were making deleted. Signals that were ignored when make was started stay ignored.
+// A second signal stops make right away, in case it does not stop after the first one.
+func (s *session) notifySignals() <-chan os.Signal {
+	c := make(chan os.Signal, 2)
+	for _, sig := range stopSignals {
+		if !signal.Ignored(sig) {
+			signal.Notify(c, sig)
+		}
+	}
+	first := make(chan os.Signal, 1)
+	go func() {
+		first <- <-c
+		s.interrupted(<-c)
+	}()
+	return first
+}
+
+// interrupted stops make after the given signal was received and the running commands
+// were killed. The jobserver is closed, and the signal is sent again with the default
+// handling, so that the parent process sees that make was killed by it. Does not return.
+func (s *session) interrupted(sig os.Signal) {
+	if s.jobserver != nil {
+		s.jobserver.Close()
+	}
+	signal.Reset(sig)
+	raise(sig)
+	os.Exit(signalStatus(sig))
+}
@@ -0,0 +1,14 @@
+package main
+
+import "os"
+
+// stopSignals are the signals that stop make, which is only Ctrl+C on Windows
+var stopSignals = []os.Signal{os.Interrupt}
+
+// raise does nothing, since a process can not send signals to itself on Windows
+func raise(sig os.Signal) {}
+
+// signalStatus returns the exit status of make after the given signal
+func signalStatus(sig os.Signal) int {
+	return 2
+}